@@ -3,11 +3,12 @@ module example.com
 go 1.25.5
 
 require (
-	github.com/cloudflare/circl v1.6.2 // indirect
+	github.com/bwesterb/go-ristretto v1.2.3 // indirect
 	golang.org/x/crypto v0.47.0 // indirect
 )
 
 require (
+	github.com/cloudflare/circl v1.6.2
 	github.com/k-atusa/USAG-Lib v0.0.0-20260131094638-3fbdf322078e
 	golang.org/x/sys v0.40.0 // indirect
 )
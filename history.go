@@ -0,0 +1,399 @@
+// project USAG AFT-desktop library: transfer history
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k-atusa/USAG-Lib/Bencrypt"
+	"github.com/k-atusa/USAG-Lib/Opsec"
+)
+
+// one transfer in history
+type TPrecord struct {
+	Time   time.Time
+	Dir    string // send, recv
+	Addr   string // peer address
+	Peer   string // fingerprint of peer identity key, or session key without identity
+	Name   string // offer name
+	Size   int64  // payload bytes moved in this session
+	Hash   string // sha3-256 hex of the bytes
+	Smsg   string
+	Result string // ok, or error text
+}
+
+// counts and hashes payload while moving
+type tally struct {
+	h    hash.Hash
+	size int64
+}
+
+func (t *tally) Write(data []byte) (int, error) {
+	t.h.Write(data)
+	t.size += int64(len(data))
+	return len(data), nil
+}
+
+// append transfer record to history, returns transfer error or history error
+func (p *TPprotocol) record(dir string, name string, peerPub []byte, smsg string, err error) error {
+	if p.History == nil {
+		return err
+	}
+	rec := TPrecord{Time: time.Now(), Dir: dir, Name: name, Smsg: smsg, Result: "ok"}
+	if addr := p.conn.RemoteAddr(); addr != nil {
+		rec.Addr = addr.String()
+	}
+	if p.PeerID != nil {
+		rec.Peer = Fingerprint(p.PeerID)
+	} else if peerPub != nil {
+		rec.Peer = Fingerprint(peerPub)
+	}
+	if p.tally != nil {
+		rec.Size = p.tally.size
+		rec.Hash = hex.EncodeToString(p.tally.h.Sum(nil))
+	}
+	if err != nil {
+		rec.Result = err.Error()
+	}
+	if herr := p.History.Append(rec); herr != nil && err == nil {
+		return p.failed(fmt.Errorf("history: %w", herr))
+	}
+	return err
+}
+
+// encrypted transfer history, plain name in unlocked Vault, or standalone opsec file with PW and KF.
+// standalone file is header + [Size(4) + Counter(8) + EncRecords(Size)]..., one record per frame,
+// so append seals only new record. Vault history is rewritten on append and keeps last HISTORY_VAULT records.
+type TPhistory struct {
+	Path  string
+	Vault *AVault
+	PW    string
+	KF    []byte
+	lock  sync.Mutex
+	head  []byte // header of standalone file, key is its body key
+	key   []byte
+	old   bool // header of one gcm1 body, rewritten to frames on append
+}
+
+// load all records, missing history is empty
+func (h *TPhistory) Load() ([]TPrecord, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.load()
+}
+
+// append record, standalone file gets one frame without reading old records
+func (h *TPhistory) Append(rec TPrecord) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// 1. Rewrite vault history, missing or old standalone file
+	var f *os.File
+	var start int64
+	var err error
+	if h.Vault == nil {
+		f, err = os.OpenFile(h.Path, os.O_RDWR, 0600)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if f != nil {
+			defer f.Close()
+			if start, err = h.header(f); err != nil {
+				return err
+			}
+		}
+	}
+	if f == nil || h.old {
+		recs, err := h.load()
+		if err != nil {
+			return err
+		}
+		recs = append(recs, rec)
+		if h.Vault != nil && len(recs) > HISTORY_VAULT {
+			recs = recs[len(recs)-HISTORY_VAULT:]
+		}
+		return h.store(recs)
+	}
+
+	// 2. Seal record after last whole frame, cutting frame left by crash
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end, err := historyEnd(f, start, info.Size())
+	if err != nil {
+		return err
+	}
+	c, err := newChunkCipher(h.key)
+	if err != nil {
+		return err
+	}
+	data := slices.Grow(encodeRecords([]TPrecord{rec}), 16)
+	counter := Opsec.DecodeInt(Bencrypt.Random(8)) // random, appending processes do not share nonce
+	frame := append(Opsec.EncodeInt(uint64(len(data)+16), 4), Opsec.EncodeInt(counter, 8)...)
+	frame = append(frame, c.seal(data, counter)...)
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(frame, end); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// records containing query in any text field, case insensitive
+func (h *TPhistory) Search(query string) ([]TPrecord, error) {
+	recs, err := h.Load()
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	res := make([]TPrecord, 0)
+	for _, r := range recs {
+		text := strings.Join([]string{r.Dir, r.Addr, r.Peer, r.Name, r.Hash, r.Smsg, r.Result}, "\n")
+		if strings.Contains(strings.ToLower(text), query) {
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
+
+func (h *TPhistory) load() ([]TPrecord, error) {
+	// 1. Read from vault
+	if h.Vault != nil {
+		if !h.Vault.exists(h.Path) {
+			return nil, nil
+		}
+		data, err := h.Vault.Read(h.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(data)
+		return decodeRecords(data)
+	}
+
+	// 2. Read standalone file
+	f, err := os.Open(h.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := h.header(f); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	if h.old {
+		var key [44]byte
+		copy(key[:], h.key)
+		plain, err := new(Bencrypt.AES1).DeAESGCM(key, body)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(plain)
+		return decodeRecords(plain)
+	}
+
+	// 3. Frames, frame cut by crash is not counted
+	c, err := newChunkCipher(h.key)
+	if err != nil {
+		return nil, err
+	}
+	end, err := historyEnd(bytes.NewReader(body), 0, int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]TPrecord, 0)
+	for pos := int64(0); pos < end; {
+		size := int64(Opsec.DecodeInt(body[pos : pos+4]))
+		plain, err := c.open(body[pos+HISTORY_FRAME:pos+HISTORY_FRAME+size], Opsec.DecodeInt(body[pos+4:pos+12]))
+		if err != nil {
+			return nil, errors.New("invalid history")
+		}
+		recs, err := decodeRecords(plain)
+		clear(plain)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, recs...)
+		pos += HISTORY_FRAME + size
+	}
+	return res, nil
+}
+
+// read header of standalone file, key is derived once per header
+func (h *TPhistory) header(f *os.File) (int64, error) {
+	var ops Opsec.Opsec
+	ops.Reset()
+	head, err := ops.Read(f, 0)
+	if err != nil {
+		return 0, err
+	}
+	if head == nil {
+		return 0, errors.New("invalid history")
+	}
+	if !bytes.Equal(head, h.head) {
+		if err := view(&ops, head); err != nil {
+			return 0, err
+		}
+		if err := ops.Decpw([]byte(h.PW), h.KF); err != nil {
+			return 0, err
+		}
+		h.head, h.key, h.old = head, ops.BodyKey, ops.BodyAlgo == "gcm1"
+	}
+	return f.Seek(0, io.SeekCurrent)
+}
+
+// end of last whole frame in r from start to size, frame cut by crash is not counted
+func historyEnd(r io.ReaderAt, start int64, size int64) (int64, error) {
+	var buf [4]byte
+	pos := start
+	for size-pos >= HISTORY_FRAME {
+		if _, err := r.ReadAt(buf[:], pos); err != nil {
+			return 0, err
+		}
+		n := int64(Opsec.DecodeInt(buf[:]))
+		if n < 16 {
+			return 0, errors.New("invalid history")
+		}
+		if n > size-pos-HISTORY_FRAME {
+			break
+		}
+		pos += HISTORY_FRAME + n
+	}
+	return pos, nil
+}
+
+func (h *TPhistory) store(recs []TPrecord) error {
+	// 1. Write to vault
+	if h.Vault != nil {
+		data := encodeRecords(recs)
+		defer clear(data)
+		return h.Vault.Write(h.Path, data)
+	}
+
+	// 2. Write standalone file of one frame per record, replaced at once so a crash keeps old records
+	var ops Opsec.Opsec
+	ops.Reset()
+	ops.Size = 0 // makes body key
+	ops.BodyAlgo = "gcmx1"
+	header, err := ops.Encpw("arg1", []byte(h.PW), h.KF)
+	if err != nil {
+		return err
+	}
+	c, err := newChunkCipher(ops.BodyKey)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	for i, rec := range recs {
+		data := slices.Grow(encodeRecords([]TPrecord{rec}), 16)
+		body.Write(Opsec.EncodeInt(uint64(len(data)+16), 4))
+		body.Write(Opsec.EncodeInt(uint64(i), 8))
+		body.Write(c.seal(data, uint64(i)))
+	}
+	if dir := filepath.Dir(h.Path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	err = writeAtomic(h.Path, func(w io.Writer) error {
+		if err := ops.Write(w, header); err != nil {
+			return err
+		}
+		_, err := w.Write(body.Bytes())
+		return err
+	})
+	if err == nil {
+		h.head, h.key, h.old = header, ops.BodyKey, false
+	}
+	return err
+}
+
+// write file through synced temp file renamed over path, path is never partly written
+func writeAtomic(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after rename
+	defer f.Close()
+	if err := write(f); err != nil { // temp file is owner only
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Count(4) + [Time(8) + Size(8) + (TextSize(4) + Text) * 7]...
+func encodeRecords(recs []TPrecord) []byte {
+	var buf bytes.Buffer
+	buf.Write(Opsec.EncodeInt(uint64(len(recs)), 4))
+	for _, r := range recs {
+		buf.Write(Opsec.EncodeInt(uint64(r.Time.Unix()), 8))
+		buf.Write(Opsec.EncodeInt(uint64(r.Size), 8))
+		for _, t := range []string{r.Dir, r.Addr, r.Peer, r.Name, r.Hash, r.Smsg, r.Result} {
+			buf.Write(Opsec.EncodeInt(uint64(len(t)), 4))
+			buf.WriteString(t)
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeRecords(data []byte) ([]TPrecord, error) {
+	if len(data) < 4 {
+		return nil, errors.New("invalid history")
+	}
+	count := Opsec.DecodeInt(data[0:4])
+	if count > uint64(len(data)) {
+		return nil, errors.New("invalid history")
+	}
+	res := make([]TPrecord, 0, count)
+	pos := 4
+	for i := uint64(0); i < count; i++ {
+		if pos+16 > len(data) {
+			return nil, errors.New("invalid history")
+		}
+		r := TPrecord{Time: time.Unix(int64(Opsec.DecodeInt(data[pos:pos+8])), 0)}
+		r.Size = int64(Opsec.DecodeInt(data[pos+8 : pos+16]))
+		pos += 16
+		texts := make([]string, 7)
+		for j := range texts {
+			if pos+4 > len(data) {
+				return nil, errors.New("invalid history")
+			}
+			n := Opsec.DecodeInt(data[pos : pos+4])
+			pos += 4
+			if n > uint64(len(data)-pos) {
+				return nil, errors.New("invalid history")
+			}
+			texts[j] = string(data[pos : pos+int(n)])
+			pos += int(n)
+		}
+		r.Dir, r.Addr, r.Peer, r.Name, r.Hash, r.Smsg, r.Result = texts[0], texts[1], texts[2], texts[3], texts[4], texts[5], texts[6]
+		res = append(res, r)
+	}
+	if pos != len(data) {
+		return nil, errors.New("invalid history")
+	}
+	return res, nil
+}
@@ -3,21 +3,39 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha3"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"math"
+	"math/bits"
 	"net"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/cloudflare/circl/group"
+	"github.com/cloudflare/circl/kem/xwing"
 	"github.com/k-atusa/USAG-Lib/Bencode"
 	"github.com/k-atusa/USAG-Lib/Bencrypt"
-	"github.com/k-atusa/USAG-Lib/Icons"
 	"github.com/k-atusa/USAG-Lib/Opsec"
 )
 
@@ -39,39 +57,712 @@ func GetIPs(v4only bool) ([]string, error) {
 	return res, nil
 }
 
+// get IPv4 broadcast addresses of local networks
+func GetBroadcasts() ([]string, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, address := range addrs {
+		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			ip := ipnet.IP.To4()
+			if ip == nil || len(ipnet.Mask) != 4 {
+				continue
+			}
+			bc := make(net.IP, 4)
+			for i := range bc {
+				bc[i] = ip[i] | ^ipnet.Mask[i]
+			}
+			res = append(res, bc.String())
+		}
+	}
+	return res, nil
+}
+
+// receiver announcement: Magic(4) + Port(2) + Name(N)
+type TPbeacon struct {
+	Name string
+	Addr string // ip:port of receiver, set by Discover
+	Port int
+}
+
+// announce receiver to targets every second until stop is closed, nil targets for all broadcast addresses
+func Announce(name string, port int, targets []string, stop chan bool) error {
+	if targets == nil {
+		bcs, err := GetBroadcasts()
+		if err != nil {
+			return err
+		}
+		targets = []string{net.JoinHostPort("255.255.255.255", fmt.Sprint(DISCOVERY_PORT))}
+		for _, bc := range bcs {
+			targets = append(targets, net.JoinHostPort(bc, fmt.Sprint(DISCOVERY_PORT)))
+		}
+	}
+	dsts := make([]*net.UDPAddr, 0, len(targets))
+	for _, t := range targets {
+		addr, err := net.ResolveUDPAddr("udp", t)
+		if err != nil {
+			return err
+		}
+		dsts = append(dsts, addr)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	packet := append([]byte("UTPD"), Opsec.EncodeInt(uint64(port), 2)...)
+	packet = append(packet, name...)
+	for {
+		for _, dst := range dsts {
+			conn.WriteToUDP(packet, dst) // skip unreachable networks
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+// listen announcements for wait duration, listen is ip:port (empty for all interfaces)
+func Discover(listen string, wait time.Duration) ([]TPbeacon, error) {
+	if listen == "" {
+		listen = net.JoinHostPort("", fmt.Sprint(DISCOVERY_PORT))
+	}
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res := make([]TPbeacon, 0)
+	found := make(map[string]bool)
+	buf := make([]byte, 512)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return res, err
+		}
+		if n < 6 || string(buf[:4]) != "UTPD" {
+			continue
+		}
+		b := TPbeacon{Name: string(buf[6:n]), Port: int(Opsec.DecodeInt(buf[4:6]))}
+		b.Addr = net.JoinHostPort(src.IP.String(), fmt.Sprint(b.Port))
+		if !found[b.Addr] {
+			found[b.Addr] = true
+			res = append(res, b)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res, nil
+}
+
+// scheme and rest of transport address: tcp://host:port or host:port, unix://path,
+// socks5://[user:pass@]proxy:port/host:port, stdio: for stdin and stdout, exec:command for pipes of child
+func SplitAddr(addr string) (string, string) {
+	if scheme, rest, ok := strings.Cut(addr, "://"); ok {
+		return strings.ToLower(scheme), rest
+	}
+	if rest, ok := strings.CutPrefix(addr, "exec:"); ok {
+		return "exec", rest
+	}
+	if addr == "stdio:" {
+		return "stdio", ""
+	}
+	return "tcp", addr
+}
+
+// connect by transport address, see SplitAddr
+func Dial(addr string) (net.Conn, error) {
+	scheme, rest := SplitAddr(addr)
+	switch scheme {
+	case "tcp", "unix":
+		return net.Dial(scheme, rest)
+	case "socks5", "socks5h": // remote name is always resolved by proxy
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		return dialSocks(u.Host, u.User, strings.TrimPrefix(u.Path, "/"))
+	case "stdio":
+		return stdioConn()
+	case "exec":
+		return execConn(rest)
+	}
+	return nil, errors.New("unknown transport: " + scheme)
+}
+
+// listen by transport address, tcp and unix only
+func Listen(addr string) (net.Listener, error) {
+	scheme, rest := SplitAddr(addr)
+	switch scheme {
+	case "tcp", "unix":
+		return net.Listen(scheme, rest)
+	}
+	return nil, errors.New("transport cannot listen: " + scheme)
+}
+
+// CONNECT through SOCKS5 proxy, no auth or username/password
+func dialSocks(proxy string, user *url.Userinfo, target string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || len(host) > 255 {
+		return nil, errors.New("invalid socks target: " + target)
+	}
+	conn, err := net.DialTimeout("tcp", proxy, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := socksConnect(conn, user, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socksConnect(conn net.Conn, user *url.Userinfo, host string, port uint16) error {
+	// 1. Greeting: Ver(1) + Count(1) + Methods, reply Ver(1) + Method(1)
+	hello := []byte{5, 1, 0}
+	if user != nil {
+		hello = []byte{5, 2, 0, 2}
+	}
+	if _, err := conn.Write(hello); err != nil {
+		return err
+	}
+	buf := make([]byte, 262)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != 5 {
+		return errors.New("invalid socks proxy")
+	}
+	switch buf[1] {
+	case 0:
+	case 2: // Ver(1) + Size(1) + User + Size(1) + Password
+		name := user.Username()
+		pw, _ := user.Password()
+		if len(name) > 255 || len(pw) > 255 {
+			return errors.New("socks credential is too long")
+		}
+		auth := append([]byte{1, byte(len(name))}, name...)
+		auth = append(append(auth, byte(len(pw))), pw...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("socks authentication failed")
+		}
+	default:
+		return errors.New("no acceptable socks auth method")
+	}
+
+	// 2. Connect: Ver(1) + Cmd(1) + Rsv(1) + AddrType(1) + Addr + Port(2 BE)
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// 3. Reply: Ver(1) + Rep(1) + Rsv(1) + AddrType(1) + Addr + Port(2)
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return fmt.Errorf("socks connect failed: code %d", buf[1])
+	}
+	size := 0
+	switch buf[3] {
+	case 1:
+		size = 4
+	case 4:
+		size = 16
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		size = int(buf[0])
+	default:
+		return errors.New("invalid socks reply")
+	}
+	_, err := io.ReadFull(conn, buf[:size+2])
+	return err
+}
+
+// net.Conn over pipes, reads and writes are pollable when fd is pipe or socket
+type pipeConn struct {
+	r    *os.File
+	w    *os.File
+	cmd  *exec.Cmd // child of exec transport
+	name string
+}
+
+// original stdin and stdout, referenced so that replacing os.Stdout does not close fd by finalizer
+var stdFiles = [2]*os.File{os.Stdin, os.Stdout}
+
+// stdin and stdout as conn, caller must not print to stdout
+func stdioConn() (net.Conn, error) {
+	syscall.SetNonblock(syscall.Stdin, true) // enable deadlines, plain file or tty stays blocking
+	syscall.SetNonblock(syscall.Stdout, true)
+	return &pipeConn{r: os.NewFile(uintptr(syscall.Stdin), "stdin"), w: os.NewFile(uintptr(syscall.Stdout), "stdout"), name: "stdio"}, nil
+}
+
+// run command with conn on its stdin and stdout, stderr is shared, e.g. "ssh host aft -m recv -addr stdio: -o out"
+func execConn(command string) (net.Conn, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("exec transport needs command")
+	}
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = inR, outW, os.Stderr
+	err = cmd.Start()
+	inR.Close()
+	outW.Close()
+	if err != nil {
+		inW.Close()
+		outR.Close()
+		return nil, err
+	}
+	return &pipeConn{r: outR, w: inW, cmd: cmd, name: "exec:" + args[0]}, nil
+}
+
+func (c *pipeConn) Read(data []byte) (int, error) {
+	return c.r.Read(data)
+}
+
+func (c *pipeConn) Write(data []byte) (int, error) {
+	return c.w.Write(data)
+}
+
+// close pipes, child gets EOF and is killed if it does not exit in 5s
+func (c *pipeConn) Close() error {
+	err := c.w.Close()
+	c.r.Close()
+	if c.cmd != nil {
+		timer := time.AfterFunc(5*time.Second, func() { c.cmd.Process.Kill() })
+		c.cmd.Wait()
+		timer.Stop()
+	}
+	return err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr(c.name)
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(c.name)
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.w.SetWriteDeadline(t)
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// word list for SAS and pairing codes, 256 words
+var wordList = [256]string{
+	"acid", "acorn", "actor", "agent", "alarm", "album", "alien", "alpha", "amber", "angle",
+	"anvil", "apple", "arena", "armor", "arrow", "aspen", "atlas", "audio", "autumn",
+	"award", "bacon", "badge", "baker", "bamboo", "banjo", "barn", "basil", "basin",
+	"beach", "beard", "bell", "bench", "berry", "bison", "blade", "blaze", "bloom", "board",
+	"boat", "bonus", "boot", "brave", "bread", "brick", "brush", "bucket", "buffalo",
+	"cabin", "cactus", "camel", "candle", "canoe", "canyon", "carbon", "cargo", "carrot",
+	"castle", "cedar", "chalk", "cherry", "chess", "chief", "cider", "circus", "citrus",
+	"clay", "cliff", "clock", "cloud", "clover", "cobra", "cocoa", "comet", "coral",
+	"cotton", "coyote", "crane", "crayon", "cricket", "crossbow", "crown", "crystal",
+	"curtain", "cycle", "daisy", "dance", "delta", "denim", "desert", "dinner", "dolphin",
+	"donkey", "dragon", "drum", "eagle", "echo", "eclipse", "ember", "emerald", "engine",
+	"falcon", "fern", "ferry", "fiddle", "flame", "flute", "forest", "fossil", "fox",
+	"frost", "galaxy", "garden", "garlic", "gecko", "ginger", "glacier", "globe", "grape",
+	"gravel", "guitar", "hammer", "harbor", "hazel", "helmet", "heron", "honey", "hornet",
+	"hotel", "indigo", "iris", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly",
+	"jewel", "jungle", "kayak", "kettle", "kiwi", "koala", "ladder", "lagoon", "lantern",
+	"laser", "lemon", "lilac", "llama", "lobster", "lotus", "magnet", "mango", "maple",
+	"marble", "meadow", "melon", "meteor", "mint", "mirror", "moose", "mosaic", "motor",
+	"nectar", "needle", "nickel", "noodle", "oasis", "ocean", "olive", "onion", "opal",
+	"orbit", "orchid", "otter", "oyster", "paddle", "palace", "panda", "parrot", "pasta",
+	"peach", "pebble", "pepper", "piano", "pigeon", "pillow", "pilot", "pine", "pirate",
+	"planet", "plaza", "plum", "pocket", "polar", "pony", "poppy", "potato", "prism",
+	"pumpkin", "puzzle", "quartz", "quill", "rabbit", "radar", "radish", "raven", "reef",
+	"ribbon", "river", "robin", "rocket", "rose", "ruby", "saddle", "salmon", "sapphire",
+	"saturn", "scarf", "shadow", "shark", "shell", "silver", "sketch", "spider", "spoon",
+	"squid", "stamp", "statue", "summit", "sunset", "swan", "tiger", "toast", "tomato",
+	"torch", "tractor", "tulip", "tundra", "turtle", "umbrella", "unicorn", "valley",
+	"velvet", "violin", "volcano", "waffle", "walnut", "walrus", "willow", "window",
+	"wizard", "yacht", "yogurt", "zebra", "zephyr",
+}
+
 // Mode Flags
 const (
-	MODE_MSGONLY uint16 = 0x1
-	MODE_LEGACY  uint16 = 0x2 // for RSA
-	MODE_RSA_4K  uint16 = 0x4 // for RSA
+	MODE_MSGONLY  uint16 = 0x1   // message session, no body
+	MODE_LEGACY   uint16 = 0x2   // for RSA
+	MODE_RSA_4K   uint16 = 0x4   // for RSA
+	MODE_RESUME   uint16 = 0x8   // transfer ID in handshake, file hash after body
+	MODE_FILES    uint16 = 0x10  // body is manifest + files
+	MODE_VERIFY   uint16 = 0x20  // SAS confirm after handshake
+	MODE_PAKE     uint16 = 0x40  // pairing code authenticates handshake
+	MODE_IDENTITY uint16 = 0x80  // identity keys sign handshake
+	MODE_PQ       uint16 = 0x100 // pqc1 hybrid keys, ECC1 + ML-KEM
+	MODE_MULTI    uint16 = 0x200 // body frames over parallel connections
+	MODE_PULL     uint16 = 0x400 // message session requesting vault entries, needs identity or pairing code
+	MODE_ALL      uint16 = 0x7FF // all known flags
+	MODE_UTP1     uint16 = 0x6   // flags usable with UTP1 peers
+
+	CIPHER_GCM1  uint16 = 0x1 // whole body AES-GCM, UTP1 peers
+	CIPHER_GCMX1 uint16 = 0x2 // chunked AES-GCM frames
+	CIPHER_ALL   uint16 = 0x3
+	COMP_NONE    uint16 = 0x1
+	COMP_DEFLATE uint16 = 0x2 // deflate per gcmx1 chunk, incompressible chunks stored
+	COMP_ALL     uint16 = 0x3
 
 	STAGE_IDLE         int = 0
 	STAGE_HANDSHAKE    int = 1
 	STAGE_ENCRYPTING   int = 2
 	STAGE_TRANSFERRING int = 3
 	STAGE_COMPLETE     int = 4
+	STAGE_OFFER        int = 5 // waiting for receiver to accept
 	STAGE_ERROR        int = -1
+
+	EVENT_STAGE    int = 1 // stage changed
+	EVENT_PROGRESS int = 2 // bytes moved, at most every PROGRESS_STEP
+	EVENT_ERROR    int = 3 // transfer failed with Err
+	PROGRESS_STEP      = 200 * time.Millisecond
+
+	PEER_NEW     int = 0 // not in trusted peers
+	PEER_TRUSTED int = 1 // same identity key
+	PEER_CHANGED int = 2 // known name with different key
+
+	DISCOVERY_PORT int = 8002 // UDP port for receiver announcement
+
+	CHUNK_SIZE   int  = 1048576 // gcmx1 plain chunk size
+	FRAME_DATA   byte = 0x1     // Type(1) + Size(4) + EncChunk(N)
+	DIGEST_FRAME      = 5 + 48  // FRAME_DATA of whole file hash after last chunk of resumable session
+	FRAME_ABORT  byte = 0x2     // Type(1) + Size(4) + Reason(N), read from older peers
+	ABORT_MAX    int  = 1024    // max reason size of abort and error frame
+	FRAME_MSG    byte = 0x3     // Type(1) + Size(4) + EncMessage(N)
+	FRAME_CLOSE  byte = 0x4     // Type(1) + Size(4), size is 0
+	FRAME_REJECT byte = 0x5     // Type(1) + Size(4) + Reason(N), read from older peers
+	FRAME_ERROR  byte = 0x6     // Type(1) + Size(4) + Code(2) + Header(N), reason is smsg to peer key
+	ERROR_MAX    int  = 16384   // max opsec header size of error frame
+	MSG_MAX      int  = 65536   // max plain message size
+
+	PULL_LIST    byte = 0x1 // request Op(1) + Folder, response Status(1) + Count(4) + [Size(2) + Name]...
+	PULL_GET     byte = 0x2 // request Op(1) + Name, response Status(1), then body as in transfer
+	PULL_OK      byte = 0x0
+	PULL_DENIED  byte = 0x1 // Status(1) + Reason, folder is not exported to peer
+	PULL_MISSING byte = 0x2 // Status(1) + Reason
+	PULL_FAILED  byte = 0x3 // Status(1) + Reason, owner could not read vault
+
+	ERROR_OTHER     uint16 = 0
+	ERROR_CANCELLED uint16 = 1 // user or context stopped transfer
+	ERROR_REJECTED  uint16 = 2 // offer declined
+	ERROR_DISK      uint16 = 3 // reading or writing local files failed
+	ERROR_DECRYPT   uint16 = 4 // chunk failed authentication or decompression
+	ERROR_TIMEOUT   uint16 = 5 // idle or total timeout
+	ERROR_POLICY    uint16 = 6 // peer field over receiver policy
+
+	PIPE_DEPTH   int     = 4     // frames read and sealed ahead of socket
+	STREAM_MAX   int     = 16    // parallel connections of MODE_MULTI
+	SEND_STEP    int     = 65536 // write size under rate limit
+	LOW_RATE_MIN float64 = 65536 // bytes/sec floor of low priority back-off
+
+	POLICY_KEY       int           = 8192             // default max peer key size
+	POLICY_PAYLOAD   int64         = 1073741824       // default max body kept in memory
+	POLICY_HANDSHAKE time.Duration = 30 * time.Second // default time for peer to finish hello
+
+	SHARE_TIMEOUT     time.Duration = 10 * time.Minute // default expiry of share link
+	PULL_IDLE_TIMEOUT time.Duration = 5 * time.Minute  // default IdleTimeout of ServePull, serving loop is not held by stalled client
+
+	HISTORY_FRAME int64 = 12    // Size(4) + Counter(8) before EncRecords(Size) of standalone history
+	HISTORY_VAULT int   = 10000 // records kept in vault history, whole file is rewritten on each append
 )
 
+// ErrIdleTimeout is returned when no byte is moved for IdleTimeout
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// ErrShareExpired is returned when share link is not downloaded before Timeout
+var ErrShareExpired = errors.New("share link expired")
+
+// ErrPairCode is returned when peer used another pairing code, make new code before next try
+var ErrPairCode = errors.New("pairing code mismatch")
+
+// transfer cancelled by peer, ERROR_CANCELLED or abort frame
+type AbortError struct {
+	Reason string
+}
+
+func (e *AbortError) Error() string {
+	return "aborted by peer: " + e.Reason
+}
+
+// offer rejected by receiver, ERROR_REJECTED
+type RejectError struct {
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return "rejected by peer: " + e.Reason
+}
+
+// peer failed to read or write its files, ERROR_DISK
+type DiskError struct {
+	Reason string
+}
+
+func (e *DiskError) Error() string {
+	return "disk error on peer: " + e.Reason
+}
+
+// peer could not decrypt body, ERROR_DECRYPT
+type DecryptError struct {
+	Reason string
+}
+
+func (e *DecryptError) Error() string {
+	return "decrypt failed on peer: " + e.Reason
+}
+
+// other error frame from peer, Code is ERROR_
+type RemoteError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *RemoteError) Error() string {
+	if name, ok := map[uint16]string{ERROR_TIMEOUT: "timeout", ERROR_POLICY: "policy"}[e.Code]; ok {
+		return "peer " + name + " error: " + e.Reason
+	}
+	return fmt.Sprintf("peer error %d: %s", e.Code, e.Reason)
+}
+
+func (e *AbortError) code() uint16   { return ERROR_CANCELLED }
+func (e *RejectError) code() uint16  { return ERROR_REJECTED }
+func (e *DiskError) code() uint16    { return ERROR_DISK }
+func (e *DecryptError) code() uint16 { return ERROR_DECRYPT }
+func (e *RemoteError) code() uint16  { return e.Code }
+
+// error reported by peer, not to be sent back
+func fromPeer(err error) bool {
+	var ce interface{ code() uint16 }
+	return errors.As(err, &ce)
+}
+
+// error type of code from error frame
+func remoteError(code uint16, reason string) error {
+	switch code {
+	case ERROR_CANCELLED:
+		return &AbortError{Reason: reason}
+	case ERROR_REJECTED:
+		return &RejectError{Reason: reason}
+	case ERROR_DISK:
+		return &DiskError{Reason: reason}
+	case ERROR_DECRYPT:
+		return &DecryptError{Reason: reason}
+	default:
+		return &RemoteError{Code: code, Reason: reason}
+	}
+}
+
+// code of local error for error frame
+func errorCode(err error) uint16 {
+	var pe *PolicyError
+	var fe *os.PathError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ERROR_CANCELLED
+	case errors.Is(err, ErrIdleTimeout) || errors.Is(err, context.DeadlineExceeded):
+		return ERROR_TIMEOUT
+	case errors.As(err, &pe):
+		return ERROR_POLICY
+	case errors.As(err, &fe) || errors.Is(err, syscall.ENOSPC):
+		return ERROR_DISK
+	}
+	return ERROR_OTHER
+}
+
+// peer field over receiver policy, Field is "key", "payload" or "handshake"
+type PolicyError struct {
+	Field string
+	Size  int64 // size sent by peer, or time taken
+	Limit int64 // bytes, or nanoseconds for handshake
+}
+
+func (e *PolicyError) Error() string {
+	if e.Field == "handshake" {
+		return fmt.Sprintf("handshake not finished in policy limit %s", time.Duration(e.Limit))
+	}
+	return fmt.Sprintf("peer %s size %d exceeds policy limit %d", e.Field, e.Size, e.Limit)
+}
+
+// receiver limits on sizes and time given by peer, 0 is default
+type TPpolicy struct {
+	MaxKeySize       int           // public and identity key fields, POLICY_KEY
+	MaxPayload       int64         // body kept in memory (gcm1, ReceiveData), POLICY_PAYLOAD
+	HandshakeTimeout time.Duration // hello packets and pairing, user prompts are not counted, POLICY_HANDSHAKE
+}
+
+// encrypted offer before body, sent in opsec header
+type TPoffer struct {
+	Name    string
+	Size    int64  // plain size to transfer
+	Type    string // content type, "files" for MODE_FILES
+	Message string // smsg
+}
+
+// transfer event for subscribers
+type TPevent struct {
+	Type  int
+	Time  time.Time
+	Stage int
+	Sent  uint64 // uncompressed frame bytes, reaches Total
+	Total uint64
+	Wire  uint64        // bytes on connection, less than Sent with compression
+	Speed float64       // bytes per second, smoothed
+	ETA   time.Duration // -1 if unknown
+	Err   error         // cause of EVENT_ERROR
+}
+
 type TPprotocol struct {
-	Mode  uint16
-	stage int
-	sent  uint64
-	total uint64
-	lock  sync.Mutex
-	conn  net.Conn
-	magic [4]byte
-	zero8 [8]byte
-	max8  [8]byte
+	Mode       uint16
+	TransferID []byte // 16B, keep it to resume with MODE_RESUME and same Identity
+
+	// handshake authentication
+	Code     string      // one-time pairing code, sets MODE_PAKE
+	Identity *TPidentity // long-term key, sets MODE_IDENTITY
+	Peers    *TPpeers    // trusted peers, new peer is added if accepted
+	PeerName string      // peer identity name after handshake
+	PeerID   []byte      // peer identity key after handshake
+
+	// SAS check with user, sets MODE_VERIFY
+	Confirm func(words string, digits string) bool
+	// accept peer identity, nil accepts only PEER_TRUSTED
+	Trust func(name string, fingerprint string, status int) bool
+
+	// capabilities, 0 is all supported
+	Version  int    // handshake to send, 0 is UTP2, 1 for old UTP1 receivers
+	Features uint16 // accepted mode flags
+	Require  uint16 // mode flags peer must set, 0 is none
+	Ciphers  uint16 // CIPHER_ flags, highest common one is used, 0 is all, gcm1 only with peers lacking gcmx1 like UTP1
+	Comps    uint16 // COMP_ flags, highest common one is used
+
+	// offer, nil Accept takes all offers under MaxSize
+	OfferName string // sender sets offer name and content type
+	OfferType string
+	Accept    func(offer TPoffer) bool
+	MaxSize   int64 // reject larger offer, 0 is no limit
+
+	Policy TPpolicy // limits on untrusted peer fields
+
+	// abort transfer on timeout, 0 is no limit
+	IdleTimeout  time.Duration // no byte moved in both ways, includes user prompts
+	TotalTimeout time.Duration // whole transfer with handshake
+
+	History *TPhistory // appends record of each transfer, nil is off
+
+	// parallel body connections, sets MODE_MULTI, frames go round robin over conn and extra ones
+	Streams      int                      // connections including conn, receiver caps it, 0 is 1
+	StreamDial   func() (net.Conn, error) // sender opens extra connection
+	StreamAccept func() (net.Conn, error) // receiver takes extra connection, nil allows conn only
+
+	stage     int
+	sent      uint64
+	wire      uint64
+	total     uint64
+	offset    uint64 // resume offset acked by receiver
+	resume    *TPresume
+	digest    hash.Hash // whole file hash of resumable session, sent after body
+	sum       []byte    // whole file hash received from sender
+	lock      sync.Mutex
+	conn      *activeConn
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	abortable bool    // abort frame can be sent to sender
+	offer     TPoffer // last offer received
+	cipher    uint16  // negotiated
+	comp      uint16  // negotiated
+	caps      []byte  // negotiated capabilities in transcript
+	tally     *tally  // payload size and hash for history
+	refuse    error   // reject handshake with reason, set by server
+	memory    bool    // body is kept in memory, bounded by policy payload
+	pulling   bool    // body is file of pull session
+	trusted   bool    // peer identity was in Peers before handshake
+	peerKey   []byte  // handshake keys to encrypt error reason
+	myKey     []byte
+	limit     rateLimit
+	nstreams  [2]int        // MODE_MULTI streams (asked, agreed)
+	streams   []*activeConn // body connections, streams[0] is conn
+	subs      map[int]func(TPevent)
+	subID     int
+	subLock   sync.RWMutex
+	lastTime  time.Time // last progress event
+	lastSent  uint64
+	speed     float64
+	magic     [4]byte
+	zero8     [8]byte
+	max8      [8]byte
 }
 
 func (p *TPprotocol) Init(mode uint16, conn net.Conn) {
 	p.Mode = mode
 	p.stage = 0
 	p.sent = 0
+	p.wire = 0
 	p.total = 0
-	p.conn = conn
-	p.magic = [4]byte{'U', 'T', 'P', '1'}
+	p.offset = 0
+	p.conn = &activeConn{Conn: conn, last: new(atomic.Int64)}
+	p.ctx, p.cancel = context.WithCancelCause(context.Background())
+	p.magic = [4]byte{'U', 'T', 'P', '2'}
 	p.zero8 = [8]byte{0, 0, 0, 0, 0, 0, 0, 0}
 	p.max8 = [8]byte{255, 255, 255, 255, 255, 255, 255, 255}
 }
@@ -82,116 +773,799 @@ func (p *TPprotocol) GetStatus() (int, uint64, uint64) {
 	return p.stage, p.sent, p.total
 }
 
-func (p *TPprotocol) setStage(stage int) {
+// bytes on connection of current transfer, less than sent of GetStatus with compression
+func (p *TPprotocol) GetWire() uint64 {
 	p.lock.Lock()
 	defer p.lock.Unlock()
-	p.stage = stage
+	return p.wire
 }
 
-func (p *TPprotocol) setSent(sent uint64) {
+func (p *TPprotocol) setStage(stage int) {
 	p.lock.Lock()
-	defer p.lock.Unlock()
-	p.sent = sent
+	changed := p.stage != stage
+	p.stage = stage
+	ev := p.event(EVENT_STAGE)
+	p.lock.Unlock()
+	if changed {
+		if stage == STAGE_COMPLETE {
+			p.emit(p.progress(true))
+		}
+		p.emit(ev)
+	}
 }
 
+// reset progress with new total size
 func (p *TPprotocol) setTotal(total uint64) {
 	p.lock.Lock()
-	defer p.lock.Unlock()
+	p.sent = 0
+	p.wire = 0
 	p.total = total
+	p.lastTime = time.Now()
+	p.lastSent = 0
+	p.speed = 0
+	ev := p.event(EVENT_PROGRESS)
+	p.lock.Unlock()
+	p.emit(ev)
 }
 
-func (p *TPprotocol) syncStatus(stop chan bool) {
-	defer func() {
-		close(stop)
-		if err := recover(); err != nil {
-			p.setStage(STAGE_ERROR)
-		}
-	}()
-	for {
-		select {
-		case s := <-stop:
-			if !s {
-				p.conn.Write(p.max8[:])
-			}
-			return
-		case <-time.After(1 * time.Second):
-			p.conn.Write(p.zero8[:])
-		}
+func (p *TPprotocol) addSent(n int) {
+	p.lock.Lock()
+	p.sent += uint64(n)
+	p.wire += uint64(n)
+	p.lock.Unlock()
+	if ev := p.progress(false); ev.Type != 0 {
+		p.emit(ev)
 	}
 }
 
-// handshake with receiver, returns (peer public key, my public key, my private key)
-func (p *TPprotocol) handshakeSend() ([]byte, []byte, []byte, error) {
-	// 1. Make key pair
-	var myPub, myPriv []byte
-	var err error
-	if p.Mode&MODE_LEGACY != 0 {
-		r := new(Bencrypt.RSA1)
-		if p.Mode&MODE_RSA_4K != 0 {
-			myPub, myPriv, err = r.Genkey(4096)
-		} else {
-			myPub, myPriv, err = r.Genkey(2048)
-		}
-	} else {
-		e := new(Bencrypt.ECC1)
-		myPub, myPriv, err = e.Genkey()
+// count bytes saved by compression as sent, progress stays in uncompressed size
+func (p *TPprotocol) addSaved(n int) {
+	if n <= 0 {
+		return
 	}
-	if err != nil {
-		p.setStage(STAGE_ERROR)
-		return nil, nil, nil, err
+	p.lock.Lock()
+	p.sent += uint64(n)
+	p.lock.Unlock()
+	if ev := p.progress(false); ev.Type != 0 {
+		p.emit(ev)
 	}
+}
 
-	// 2. Prepare Packet: Magic(4) + Mode(2) + PubSize(2) + PubKey(N)
-	buf := make([]byte, 8+len(myPub))
-	copy(buf[0:4], p.magic[:])
-	pubLen := len(myPub)
-	if pubLen > 65535 {
-		return nil, nil, nil, errors.New("public key is too long")
+// make event from current status, lock must be held
+func (p *TPprotocol) event(typ int) TPevent {
+	ev := TPevent{Type: typ, Time: time.Now(), Stage: p.stage, Sent: p.sent, Total: p.total, Wire: p.wire, Speed: p.speed, ETA: -1}
+	if p.speed > 0 && p.total >= p.sent {
+		ev.ETA = time.Duration(float64(p.total-p.sent) / p.speed * float64(time.Second))
 	}
-	copy(buf[4:6], Opsec.EncodeInt(uint64(p.Mode), 2))
-	copy(buf[6:8], Opsec.EncodeInt(uint64(pubLen), 2))
-	copy(buf[8:], myPub)
+	return ev
+}
 
-	// 3. Send Packet
-	if _, err := p.conn.Write(buf); err != nil {
-		return nil, nil, nil, err
+// progress event once per PROGRESS_STEP or forced, zero Type if skipped
+func (p *TPprotocol) progress(force bool) TPevent {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	dt := time.Since(p.lastTime)
+	if !force && dt < PROGRESS_STEP {
+		return TPevent{}
+	}
+	if dt > 0 && p.sent >= p.lastSent {
+		inst := float64(p.sent-p.lastSent) / dt.Seconds()
+		if p.speed == 0 {
+			p.speed = inst
+		} else {
+			p.speed = 0.7*p.speed + 0.3*inst
+		}
 	}
+	p.lastTime = time.Now()
+	p.lastSent = p.sent
+	return p.event(EVENT_PROGRESS)
+}
 
-	// 4. Receive Response: PubSize(2) + PubKey(M)
-	head := make([]byte, 2)
-	if _, err := io.ReadFull(p.conn, head); err != nil {
-		return nil, nil, nil, err
+// send event to subscribers
+func (p *TPprotocol) emit(ev TPevent) {
+	p.subLock.RLock()
+	defer p.subLock.RUnlock()
+	for _, fn := range p.subs {
+		fn(ev)
 	}
-	peerPubLen := Opsec.DecodeInt(head)
-	peerPub := make([]byte, int(peerPubLen))
-	if _, err := io.ReadFull(p.conn, peerPub); err != nil {
-		return nil, nil, nil, err
+}
+
+// Subscribe calls fn for each event until unsubscribe is called.
+// fn may run on transfer goroutines, it must not block or subscribe
+func (p *TPprotocol) Subscribe(fn func(TPevent)) func() {
+	p.subLock.Lock()
+	defer p.subLock.Unlock()
+	if p.subs == nil {
+		p.subs = make(map[int]func(TPevent))
+	}
+	p.subID++
+	id := p.subID
+	p.subs[id] = fn
+	return func() {
+		p.subLock.Lock()
+		defer p.subLock.Unlock()
+		delete(p.subs, id)
+	}
+}
+
+// Events returns buffered event channel, events are dropped when buffer is full.
+// channel is closed by unsubscribe
+func (p *TPprotocol) Events(size int) (<-chan TPevent, func()) {
+	ch := make(chan TPevent, size)
+	unsub := p.Subscribe(func(ev TPevent) {
+		select {
+		case ch <- ev:
+		default:
+		}
+	})
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			unsub()
+			close(ch)
+		})
+	}
+}
+
+// write to conn, count as sent, paced by rate limit
+func (p *TPprotocol) send(data []byte) error {
+	return p.sendTo(p.conn, data)
+}
+
+func (p *TPprotocol) sendTo(c *activeConn, data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if p.limit.active() {
+			n = min(n, SEND_STEP)
+			if err := p.limit.wait(p.ctx, n); err != nil {
+				return err
+			}
+		}
+		start := time.Now()
+		n, err := c.Write(data[:n])
+		p.limit.observe(n, time.Since(start))
+		p.addSent(n)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// Limit send rate to bytes/sec with burst bytes, 0 rate is no limit, 0 burst is SEND_STEP.
+// safe to call during transfer
+func (p *TPprotocol) SetRate(rate int64, burst int64) {
+	p.limit.set(rate, burst)
+}
+
+// Low priority backs off when writes stall, yields uplink to other traffic.
+// safe to call during transfer
+func (p *TPprotocol) SetLowPriority(low bool) {
+	p.limit.setLow(low)
+}
+
+// send rate limiter, token bucket with low priority back-off
+type rateLimit struct {
+	lock    sync.Mutex
+	rate    float64 // bytes/sec set by user, 0 is no limit
+	burst   float64
+	low     bool
+	lowRate float64 // back-off rate, 0 is not backed off
+	fast    float64 // shortest write time per byte seen
+	tokens  float64
+	last    time.Time
+}
+
+func (r *rateLimit) set(rate int64, burst int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refill()
+	r.rate = float64(max(rate, 0))
+	r.burst = float64(max(burst, int64(SEND_STEP)))
+	r.tokens = min(r.tokens, r.burst)
+}
+
+func (r *rateLimit) setLow(low bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.refill()
+	r.low = low
+	r.lowRate, r.fast = 0, 0
+	r.burst = max(r.burst, float64(SEND_STEP))
+}
+
+func (r *rateLimit) active() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.rate > 0 || r.low
+}
+
+// current limit, lock must be held
+func (r *rateLimit) limit() float64 {
+	lim := r.rate
+	if r.low && r.lowRate > 0 && (lim == 0 || r.lowRate < lim) {
+		lim = r.lowRate
+	}
+	return lim
+}
+
+// add tokens for elapsed time, lock must be held
+func (r *rateLimit) refill() {
+	now := time.Now()
+	if lim := r.limit(); lim <= 0 {
+		r.tokens = r.burst
+	} else if !r.last.IsZero() {
+		r.tokens = min(r.tokens+now.Sub(r.last).Seconds()*lim, r.burst)
+	}
+	r.last = now
+}
+
+// take n tokens, sleep until bucket is out of debt, rate change applies while sleeping
+func (r *rateLimit) wait(ctx context.Context, n int) error {
+	r.lock.Lock()
+	r.refill()
+	r.tokens -= float64(n)
+	r.lock.Unlock()
+	for {
+		r.lock.Lock()
+		r.refill()
+		lim, tokens := r.limit(), r.tokens
+		r.lock.Unlock()
+		if lim <= 0 || tokens >= 0 {
+			return nil
+		}
+		d := min(time.Duration(-tokens/lim*float64(time.Second)), 100*time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-time.After(d):
+		}
+	}
+}
+
+// low priority: write slower than twice the fastest one means queue is building up,
+// halve rate to measured speed, else grow 10% until back to full speed
+func (r *rateLimit) observe(n int, d time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.low || n < SEND_STEP/2 {
+		return
+	}
+	per := max(d.Seconds(), 1e-9) / float64(n)
+	if r.fast == 0 || per < r.fast {
+		r.fast = per
+	}
+	if per > 2*r.fast {
+		r.lowRate = max(float64(n)/max(d.Seconds(), 1e-9)/2, LOW_RATE_MIN)
+	} else if r.lowRate > 0 {
+		r.lowRate *= 1.1
+		if r.lowRate > 1/r.fast {
+			r.lowRate = 0
+		}
+	}
+}
+
+// read full from conn, count as sent
+func (p *TPprotocol) recv(data []byte) error {
+	_, err := io.ReadFull(statusReader{p}, data)
+	return err
+}
+
+func (p *TPprotocol) recvFrom(c *activeConn, data []byte) error {
+	if c == p.conn {
+		return p.recv(data)
+	}
+	n, err := io.ReadFull(c, data)
+	p.addSent(n)
+	return err
+}
+
+// conn reader counting received bytes
+type statusReader struct {
+	p *TPprotocol
+}
+
+func (r statusReader) Read(data []byte) (int, error) {
+	n, err := r.p.conn.Read(data)
+	r.p.addSent(n)
+	return n, err
+}
+
+// conn recording last activity for idle timeout
+type activeConn struct {
+	net.Conn
+	last *atomic.Int64 // unix nano, shared by streams of transfer
+}
+
+func (c *activeConn) Read(data []byte) (int, error) {
+	n, err := c.Conn.Read(data)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *activeConn) Write(data []byte) (int, error) {
+	n, err := c.Conn.Write(data)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// start transfer under ctx with timeouts, returns end func
+func (p *TPprotocol) begin(ctx context.Context) func() {
+	// 1. Make transfer context
+	stopTimer := context.CancelFunc(func() {})
+	if p.TotalTimeout > 0 {
+		ctx, stopTimer = context.WithTimeout(ctx, p.TotalTimeout)
+	}
+	p.ctx, p.cancel = context.WithCancelCause(ctx)
+	p.abortable = false
+	p.offer = TPoffer{}
+	p.peerKey, p.myKey = nil, nil
+	p.trusted = false
+	p.digest, p.sum = nil, nil
+	p.tally = nil
+	if p.History != nil {
+		p.tally = &tally{h: sha3.New256()}
+	}
+	p.conn.last.Store(time.Now().UnixNano())
+
+	// 2. Unblock conn when done, reads at once and writes after grace for abort frame
+	tick := time.Second
+	if p.IdleTimeout > 0 {
+		tick = min(tick, max(p.IdleTimeout/4, time.Millisecond))
+	}
+	done := make(chan bool)
+	exited := make(chan bool)
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.ctx.Done():
+				p.conn.SetReadDeadline(time.Now())
+				p.conn.SetWriteDeadline(time.Now().Add(time.Second))
+				for _, c := range p.extraStreams() {
+					c.SetReadDeadline(time.Now())
+					c.SetWriteDeadline(time.Now().Add(time.Second))
+				}
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				idle := time.Since(time.Unix(0, p.conn.last.Load()))
+				if p.IdleTimeout > 0 && idle > p.IdleTimeout {
+					p.cancel(ErrIdleTimeout)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		p.conn.SetDeadline(time.Time{})
+		p.cancel(nil)
+		stopTimer()
+	}
+}
+
+// replace error with cause when transfer is cancelled, tell sender if possible, emit error event
+func (p *TPprotocol) cause(err error) error {
+	if err == nil {
+		return nil
+	}
+	if p.ctx.Err() != nil {
+		err = context.Cause(p.ctx)
+		if p.abortable && !fromPeer(err) {
+			p.abort(err, false)
+		}
+		p.setStage(STAGE_ERROR)
+	}
+	return p.failed(err)
+}
+
+// emit error event outside of transfer, returns err
+func (p *TPprotocol) failed(err error) error {
+	p.lock.Lock()
+	ev := p.event(EVENT_ERROR)
+	p.lock.Unlock()
+	ev.Err = err
+	p.emit(ev)
+	return err
+}
+
+// send error frame with reason, max8 first if peer reads status words
+func (p *TPprotocol) abort(err error, status bool) {
+	frame := p.errorFrame(errorCode(err), err.Error())
+	buf := frame
+	if status {
+		buf = append(p.max8[:], frame...)
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	p.conn.Write(buf)
+	for _, c := range p.extraStreams() { // receiver may be reading any stream
+		c.SetWriteDeadline(time.Now().Add(time.Second))
+		c.Write(frame)
+	}
+}
+
+// tell peer about local error, error frame or max8 for UTP1 peer
+func (p *TPprotocol) report(code uint16, err error) {
+	if string(p.magic[:]) == "UTP2" {
+		p.conn.Write(p.errorFrame(code, err.Error()))
+	} else {
+		p.conn.Write(p.max8[:])
+	}
+}
+
+// tell UTP2 peer why authentication failed, frame has no header before keys are set.
+// receiver reads status words, so sender puts max8 first like abort. returns err
+func (p *TPprotocol) halt(code uint16, err error, isSender bool) error {
+	if string(p.magic[:]) != "UTP2" || fromPeer(err) {
+		return err
+	}
+	if c := errorCode(err); c != ERROR_OTHER {
+		code = c
+	}
+	buf := p.errorFrame(code, err.Error())
+	if isSender {
+		buf = append(p.max8[:], buf...)
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	p.conn.Write(buf)
+	return err
+}
+
+// read error frame after max8 status word, fallback if peer sent none
+func (p *TPprotocol) readFailure(fallback error) error {
+	var head [5]byte
+	p.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(p.conn, head[:]); err == nil && isErrorFrame(head[0]) {
+		return p.readError(p.conn, head[0], Opsec.DecodeInt(head[1:5]))
+	}
+	return fallback
+}
+
+// Type(1) + Size(4) + Code(2) + Header(N), reason is cut to ABORT_MAX and sealed in opsec smsg,
+// header is empty before handshake keys are known
+func (p *TPprotocol) errorFrame(code uint16, reason string) []byte {
+	if len(reason) > ABORT_MAX {
+		reason = reason[:ABORT_MAX]
+	}
+	var head bytes.Buffer
+	if p.peerKey != nil {
+		ops := new(Opsec.Opsec)
+		ops.Reset()
+		ops.Size = 0
+		ops.Smsg = reason
+		if h, err := encpub(ops, p.headAlgo(), p.peerKey, p.myKey); err == nil {
+			ops.Write(&head, h)
+		}
+	}
+	buf := make([]byte, 0, 7+head.Len())
+	buf = append(buf, FRAME_ERROR)
+	buf = append(buf, Opsec.EncodeInt(uint64(2+head.Len()), 4)...)
+	buf = append(buf, Opsec.EncodeInt(uint64(code), 2)...)
+	return append(buf, head.Bytes()...)
+}
+
+// frame types carrying peer error
+func isErrorFrame(typ byte) bool {
+	return typ == FRAME_ERROR || typ == FRAME_ABORT || typ == FRAME_REJECT
+}
+
+// read peer error after Type(1) + Size(4) of error, abort or reject frame
+func (p *TPprotocol) readError(r io.Reader, typ byte, size uint64) error {
+	if typ != FRAME_ERROR { // plain reason of older peers
+		if size > uint64(ABORT_MAX) {
+			return errors.New("invalid frame")
+		}
+		reason := make([]byte, size)
+		if _, err := io.ReadFull(r, reason); err != nil {
+			return err
+		}
+		if typ == FRAME_REJECT {
+			return &RejectError{Reason: string(reason)}
+		}
+		return &AbortError{Reason: string(reason)}
+	}
+	if size < 2 || size > uint64(2+ERROR_MAX) {
+		return errors.New("invalid frame")
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	code := uint16(Opsec.DecodeInt(buf[:2]))
+	reason := "(no reason)"
+	if len(buf) > 2 {
+		reason = "(unreadable reason)"
+		ops := new(Opsec.Opsec)
+		if head, err := ops.Read(bytes.NewReader(buf[2:]), 1); err == nil && head != nil {
+			if view(ops, head) == nil && decpub(ops, p.headAlgo(), p.myKey, p.peerKey) == nil {
+				reason = ops.Smsg
+			}
+		}
+	}
+	return remoteError(code, reason)
+}
+
+// read offer verdict or termination from receiver: zero8, max8 or error frame
+func (p *TPprotocol) readTerm() error {
+	var term [8]byte
+	if _, err := io.ReadFull(p.conn, term[:1]); err != nil {
+		return err
+	}
+	if isErrorFrame(term[0]) {
+		typ := term[0]
+		if _, err := io.ReadFull(p.conn, term[:4]); err != nil {
+			return err
+		}
+		return p.readError(p.conn, typ, Opsec.DecodeInt(term[:4]))
+	}
+	if _, err := io.ReadFull(p.conn, term[1:]); err != nil {
+		return err
+	}
+	if term != p.zero8 {
+		return errors.New("abnormal termination signal")
+	}
+	return nil
+}
+
+// send keepalive while preparing, nil error to start, or abort with error
+func (p *TPprotocol) syncStatus(stop chan error) {
+	defer func() {
+		close(stop)
+		if err := recover(); err != nil {
+			p.setStage(STAGE_ERROR)
+		}
+	}()
+	for {
+		select {
+		case err := <-stop:
+			if err != nil && !fromPeer(err) {
+				p.abort(err, true)
+			}
+			return
+		case <-time.After(1 * time.Second):
+			p.conn.Write(p.zero8[:])
+		}
+	}
+}
+
+// handshake with receiver, returns (peer public key, my public key, my private key)
+func (p *TPprotocol) handshakeSend() ([]byte, []byte, []byte, error) {
+	// 1. Make key pair
+	var myPub, myPriv []byte
+	var err error
+	if p.Mode&MODE_LEGACY != 0 {
+		r := new(Bencrypt.RSA1)
+		if p.Mode&MODE_RSA_4K != 0 {
+			myPub, myPriv, err = r.Genkey(4096)
+		} else {
+			myPub, myPriv, err = r.Genkey(2048)
+		}
+	} else if p.Mode&MODE_PQ != 0 {
+		myPub, myPriv, err = genHybrid()
+	} else {
+		e := new(Bencrypt.ECC1)
+		myPub, myPriv, err = e.Genkey()
+	}
+	if err != nil {
+		p.setStage(STAGE_ERROR)
+		return nil, nil, nil, err
+	}
+
+	// 2. Prepare Packet
+	// UTP2: Magic(4) + Mode(2) + Features(2) + Ciphers(2) + Comps(2) + PubSize(2) + PubKey(N)
+	// UTP1: Magic(4) + Mode(2) + PubSize(2) + PubKey(N)
+	// with MODE_VERIFY, PubKey is Hash(32) commitment, key is revealed after response
+	if p.Confirm != nil {
+		p.Mode |= MODE_VERIFY
+	}
+	if p.Code != "" {
+		p.Mode |= MODE_PAKE
+	}
+	if p.Identity != nil {
+		p.Mode |= MODE_IDENTITY
+	}
+	if p.Streams > 1 && p.StreamDial != nil && p.Version != 1 && p.Mode&MODE_MSGONLY == 0 {
+		p.Mode |= MODE_MULTI
+	}
+	if err := validMode(p.Mode, p.Version == 1); err != nil {
+		return nil, nil, nil, err
+	}
+	if p.Mode&p.Require != p.Require {
+		return nil, nil, nil, fmt.Errorf("required mode flags are not set: 0x%x", p.Require&^p.Mode)
+	}
+	pubLen := len(myPub)
+	if pubLen > 65535 {
+		return nil, nil, nil, errors.New("public key is too long")
+	}
+	if p.Version == 1 {
+		p.magic = [4]byte{'U', 'T', 'P', '1'}
+		p.cipher, p.comp, p.caps = CIPHER_GCM1, COMP_NONE, nil
+	} else {
+		p.magic = [4]byte{'U', 'T', 'P', '2'}
+		p.caps = make([]byte, 0, 10)
+		p.caps = append(p.caps, Opsec.EncodeInt(uint64(p.features()), 2)...)
+		p.caps = append(p.caps, Opsec.EncodeInt(uint64(p.ciphers()), 2)...)
+		p.caps = append(p.caps, Opsec.EncodeInt(uint64(p.comps()), 2)...)
+	}
+	hello := myPub
+	if p.Mode&MODE_VERIFY != 0 { // receiver key must not depend on mine, SAS can't be ground
+		hello = sasCommit(myPub)
+	}
+	buf := make([]byte, 0, 14+len(hello)+16)
+	buf = append(buf, p.magic[:]...)
+	buf = append(buf, Opsec.EncodeInt(uint64(p.Mode), 2)...)
+	buf = append(buf, p.caps...)
+	buf = append(buf, Opsec.EncodeInt(uint64(len(hello)), 2)...)
+	buf = append(buf, hello...)
+	if p.Mode&MODE_RESUME != 0 { // TransferID(16)
+		if len(p.TransferID) != 16 {
+			p.TransferID = Bencrypt.Random(16)
+		}
+		buf = append(buf, p.TransferID...)
+	}
+	p.nstreams = [2]int{1, 1}
+	if p.Mode&MODE_MULTI != 0 { // Streams(1)
+		p.nstreams[0] = min(p.Streams, STREAM_MAX)
+		buf = append(buf, byte(p.nstreams[0]))
+	}
+
+	// 3. Send Packet
+	if _, err := p.conn.Write(buf); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// 4. Receive Response
+	// UTP2: Magic(4) + Mode(2) + Cipher(2) + Comp(2) + PubSize(2) + PubKey(M), or Magic(4) "UTPE" + Size(2) + Reason
+	// UTP1: PubSize(2) + PubKey(M)
+	if p.Version != 1 {
+		if err := p.readAccept(); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(p.conn, head); err != nil {
+		return nil, nil, nil, err
+	}
+	peerPubLen := Opsec.DecodeInt(head)
+	if peerPubLen > uint64(p.keyLimit()) {
+		return nil, nil, nil, &PolicyError{Field: "key", Size: int64(peerPubLen), Limit: int64(p.keyLimit())}
+	}
+	peerPub := make([]byte, int(peerPubLen))
+	if _, err := io.ReadFull(p.conn, peerPub); err != nil {
+		return nil, nil, nil, err
+	}
+	if p.Mode&MODE_RESUME != 0 { // Offset(8)
+		var buf8 [8]byte
+		if _, err := io.ReadFull(p.conn, buf8[:]); err != nil {
+			return nil, nil, nil, err
+		}
+		p.offset = Opsec.DecodeInt(buf8[:])
+	}
+	if p.Mode&MODE_MULTI != 0 { // Streams(1)
+		var buf1 [1]byte
+		if _, err := io.ReadFull(p.conn, buf1[:]); err != nil {
+			return nil, nil, nil, err
+		}
+		if p.nstreams[1] = int(buf1[0]); p.nstreams[1] < 1 || p.nstreams[1] > p.nstreams[0] {
+			return nil, nil, nil, errors.New("invalid stream count from receiver")
+		}
+	}
+
+	// 5. Reveal committed key: PubSize(2) + PubKey(N)
+	if p.Mode&MODE_VERIFY != 0 {
+		reveal := append(Opsec.EncodeInt(uint64(pubLen), 2), myPub...)
+		if _, err := p.conn.Write(reveal); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// 6. Authenticate keys with pairing code or identity, confirm SAS
+	if p.Mode&MODE_PAKE != 0 {
+		if err := p.pake(myPub, peerPub, true); err != nil {
+			return nil, nil, nil, p.halt(ERROR_REJECTED, err, true)
+		}
+	}
+	if p.Mode&MODE_IDENTITY != 0 {
+		if err := p.identify(myPub, peerPub, true); err != nil {
+			return nil, nil, nil, p.halt(ERROR_REJECTED, err, true)
+		}
+	}
+	if p.Mode&MODE_VERIFY != 0 {
+		if err := p.verify(myPub, peerPub); err != nil {
+			return nil, nil, nil, p.halt(ERROR_REJECTED, err, true)
+		}
 	}
+	p.peerKey, p.myKey = peerPub, myPriv
 	return peerPub, myPub, myPriv, nil
 }
 
 // handshake with sender, returns (peer public key, my public key, my private key)
 func (p *TPprotocol) handshakeReceive() ([]byte, []byte, []byte, error) {
-	// 1. Receive Packet: Magic(4) + Mode(2) + PubSize(2)
-	header := make([]byte, 8)
+	// peer must finish hello and pairing in time, cancel unblocks conn
+	limit := p.handshakeLimit()
+	timer := time.AfterFunc(limit, func() {
+		p.cancel(&PolicyError{Field: "handshake", Size: int64(limit), Limit: int64(limit)})
+	})
+	defer timer.Stop()
+
+	// 1. Receive Packet: Magic(4) + Mode(2)
+	header := make([]byte, 6)
 	if _, err := io.ReadFull(p.conn, header); err != nil {
 		return nil, nil, nil, err
 	}
 
-	// 2. Validate Magic
-	if string(header[:4]) != string(p.magic[:]) {
+	// 2. Validate Magic, read Features(2) + Ciphers(2) + Comps(2) for UTP2, PubSize(2)
+	var peerCaps []byte
+	switch string(header[:4]) {
+	case "UTP2":
+		peerCaps = make([]byte, 8)
+	case "UTP1":
+		if p.ciphers()&CIPHER_GCM1 == 0 {
+			return nil, nil, nil, errors.New("UTP1 peer is not allowed")
+		}
+		peerCaps = make([]byte, 2)
+	default:
 		return nil, nil, nil, errors.New("invalid magic number")
 	}
+	copy(p.magic[:], header[:4])
+	if _, err := io.ReadFull(p.conn, peerCaps); err != nil {
+		return nil, nil, nil, err
+	}
+	peerPubLen := Opsec.DecodeInt(peerCaps[len(peerCaps)-2:]) // PubSize (2B)
 
-	// 3. Parse Mode & Peer PubKey Length
+	// 3. Check Mode, agree on capabilities
 	p.Mode = uint16(Opsec.DecodeInt(header[4:6])) // Mode (2B)
-	peerPubLen := Opsec.DecodeInt(header[6:8])    // PubSize (2B)
+	if err := p.negotiate(peerCaps[:len(peerCaps)-2]); err != nil {
+		return nil, nil, nil, err
+	}
 
 	// 4. Receive Peer Public Key
+	if peerPubLen > uint64(p.keyLimit()) {
+		err := &PolicyError{Field: "key", Size: int64(peerPubLen), Limit: int64(p.keyLimit())}
+		p.rejectHello(err)
+		return nil, nil, nil, err
+	}
 	peerPub := make([]byte, peerPubLen)
 	if _, err := io.ReadFull(p.conn, peerPub); err != nil {
 		return nil, nil, nil, err
 	}
+	commit := []byte(nil)
+	if p.Mode&MODE_VERIFY != 0 { // sender key follows response
+		if commit, peerPub = peerPub, nil; len(commit) != 32 {
+			return nil, nil, nil, errors.New("invalid key commitment")
+		}
+	}
+	p.TransferID = nil
+	p.offset = 0
+	if p.Mode&MODE_RESUME != 0 { // TransferID(16)
+		p.TransferID = make([]byte, 16)
+		if _, err := io.ReadFull(p.conn, p.TransferID); err != nil {
+			return nil, nil, nil, err
+		}
+		if p.resume != nil && p.resumable() { // only a known identity can resume, checked after identify
+			p.offset = p.resume.offset(p.TransferID)
+		}
+	}
+	p.nstreams = [2]int{1, 1}
+	if p.Mode&MODE_MULTI != 0 { // Streams(1), agree on less if extra connections are not allowed
+		var buf1 [1]byte
+		if _, err := io.ReadFull(p.conn, buf1[:]); err != nil {
+			return nil, nil, nil, err
+		}
+		p.nstreams[0] = int(buf1[0])
+		if p.StreamAccept != nil && p.cipher == CIPHER_GCMX1 {
+			p.nstreams[1] = max(min(p.nstreams[0], p.Streams, STREAM_MAX), 1)
+		}
+	}
 
 	// 5. Generate My Key Pair based on Mode
 	var myPub, myPriv []byte
@@ -203,6 +1577,8 @@ func (p *TPprotocol) handshakeReceive() ([]byte, []byte, []byte, error) {
 		} else {
 			myPub, myPriv, err = r.Genkey(2048)
 		}
+	} else if p.Mode&MODE_PQ != 0 {
+		myPub, myPriv, err = genHybrid()
 	} else {
 		e := new(Bencrypt.ECC1)
 		myPub, myPriv, err = e.Genkey()
@@ -211,134 +1587,1391 @@ func (p *TPprotocol) handshakeReceive() ([]byte, []byte, []byte, error) {
 		return nil, nil, nil, err
 	}
 
-	// 6. Send Response: PubSize(2) + PubKey(M)
+	// 6. Send Response: [Magic(4) + Mode(2) + Cipher(2) + Comp(2)] + PubSize(2) + PubKey(M)
 	myPubLen := len(myPub)
 	if myPubLen > 65535 {
 		return nil, nil, nil, errors.New("generated public key is too long")
 	}
-	resp := make([]byte, 2+myPubLen)
-	copy(resp[0:2], Opsec.EncodeInt(uint64(myPubLen), 2))
-	copy(resp[2:], myPub)
+	resp := make([]byte, 0, 12+myPubLen+8)
+	if string(p.magic[:]) == "UTP2" {
+		resp = append(resp, p.magic[:]...)
+		resp = append(resp, Opsec.EncodeInt(uint64(p.Mode), 2)...)
+		resp = append(resp, p.caps[6:]...)
+	}
+	resp = append(resp, Opsec.EncodeInt(uint64(myPubLen), 2)...)
+	resp = append(resp, myPub...)
+	if p.Mode&MODE_RESUME != 0 { // Offset(8)
+		resp = append(resp, Opsec.EncodeInt(p.offset, 8)...)
+	}
+	if p.Mode&MODE_MULTI != 0 { // Streams(1)
+		resp = append(resp, byte(p.nstreams[1]))
+	}
 	if _, err := p.conn.Write(resp); err != nil {
 		return nil, nil, nil, err
 	}
-	return peerPub, myPub, myPriv, nil
+
+	// 7. Receive committed sender key: PubSize(2) + PubKey(N)
+	if commit != nil {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(p.conn, head); err != nil {
+			return nil, nil, nil, err
+		}
+		if size := Opsec.DecodeInt(head); size > uint64(p.keyLimit()) {
+			return nil, nil, nil, &PolicyError{Field: "key", Size: int64(size), Limit: int64(p.keyLimit())}
+		}
+		peerPub = make([]byte, Opsec.DecodeInt(head))
+		if _, err := io.ReadFull(p.conn, peerPub); err != nil {
+			return nil, nil, nil, err
+		}
+		if !hmac.Equal(sasCommit(peerPub), commit) {
+			return nil, nil, nil, p.halt(ERROR_OTHER, errors.New("sender key does not match commitment"), false)
+		}
+	}
+
+	// 8. Authenticate keys with pairing code or identity, confirm SAS
+	if p.Mode&MODE_PAKE != 0 {
+		if err := p.pake(peerPub, myPub, false); err != nil {
+			return nil, nil, nil, p.halt(ERROR_REJECTED, err, false)
+		}
+	}
+	timer.Stop() // user may be prompted from here
+	if p.Mode&MODE_IDENTITY != 0 {
+		if err := p.identify(peerPub, myPub, false); err != nil {
+			return nil, nil, nil, p.halt(ERROR_REJECTED, err, false)
+		}
+	}
+	if p.Mode&MODE_VERIFY != 0 {
+		if err := p.verify(peerPub, myPub); err != nil {
+			return nil, nil, nil, p.halt(ERROR_REJECTED, err, false)
+		}
+	}
+	p.peerKey, p.myKey = peerPub, myPriv
+	return peerPub, myPub, myPriv, nil
+}
+
+func (p *TPprotocol) features() uint16 {
+	if p.Features == 0 {
+		return MODE_ALL
+	}
+	return p.Features
+}
+
+func (p *TPprotocol) ciphers() uint16 {
+	if p.Ciphers == 0 { // UTP1 peers can't authenticate, negotiate refuses them if Identity, Code or Confirm is set
+		return CIPHER_ALL
+	}
+	return p.Ciphers
+}
+
+func (p *TPprotocol) keyLimit() int {
+	if p.Policy.MaxKeySize <= 0 {
+		return POLICY_KEY
+	}
+	return p.Policy.MaxKeySize
+}
+
+func (p *TPprotocol) payloadLimit() int64 {
+	if p.Policy.MaxPayload <= 0 {
+		return POLICY_PAYLOAD
+	}
+	return p.Policy.MaxPayload
+}
+
+func (p *TPprotocol) handshakeLimit() time.Duration {
+	if p.Policy.HandshakeTimeout <= 0 {
+		return POLICY_HANDSHAKE
+	}
+	return p.Policy.HandshakeTimeout
+}
+
+func (p *TPprotocol) comps() uint16 {
+	if p.Comps == 0 {
+		return COMP_ALL
+	}
+	return p.Comps
+}
+
+// highest common flag, 0 if none
+func pickCap(a uint16, b uint16) uint16 {
+	if a&b == 0 {
+		return 0
+	}
+	return 1 << (bits.Len16(a&b) - 1)
+}
+
+// check flag is single and supported
+func validCap(c uint16, mine uint16) bool {
+	return c != 0 && c&(c-1) == 0 && c&mine != 0
+}
+
+// reject unknown or contradictory mode flags
+func validMode(mode uint16, utp1 bool) error {
+	if mode&^MODE_ALL != 0 {
+		return fmt.Errorf("unknown mode flags: 0x%x", mode&^MODE_ALL)
+	}
+	if utp1 && mode&^MODE_UTP1 != 0 {
+		return fmt.Errorf("mode flags need UTP2 peer: 0x%x", mode&^MODE_UTP1)
+	}
+	if mode&MODE_RSA_4K != 0 && mode&MODE_LEGACY == 0 {
+		return errors.New("contradictory mode flags: RSA 4K without legacy")
+	}
+	if mode&MODE_PQ != 0 && mode&MODE_LEGACY != 0 {
+		return errors.New("contradictory mode flags: hybrid with legacy")
+	}
+	if mode&MODE_MULTI != 0 && mode&MODE_MSGONLY != 0 {
+		return errors.New("contradictory mode flags: message with streams")
+	}
+	if mode&MODE_MSGONLY != 0 && mode&(MODE_FILES|MODE_RESUME) != 0 {
+		return errors.New("contradictory mode flags: message with files or resume")
+	}
+	if mode&MODE_PULL != 0 && mode&MODE_MSGONLY == 0 {
+		return errors.New("contradictory mode flags: pull without message")
+	}
+	if mode&MODE_PULL != 0 && mode&(MODE_IDENTITY|MODE_PAKE) == 0 {
+		return errors.New("pull needs identity or pairing code")
+	}
+	return nil
+}
+
+// receiver checks Mode and agrees on capabilities, peerCaps is Features(2) + Ciphers(2) + Comps(2) or empty for UTP1
+func (p *TPprotocol) negotiate(peerCaps []byte) error {
+	// 1. Check Mode against my features
+	utp1 := len(peerCaps) == 0
+	err := validMode(p.Mode, utp1)
+	if err == nil && p.Mode&^p.features() != 0 {
+		err = fmt.Errorf("unsupported mode flags: 0x%x", p.Mode&^p.features())
+	}
+	if err == nil && p.Mode&p.Require != p.Require {
+		err = fmt.Errorf("peer did not set required mode flags: 0x%x", p.Require&^p.Mode)
+	}
+	if err == nil && p.Code != "" && p.Mode&MODE_PAKE == 0 {
+		err = errors.New("peer did not use pairing code")
+	}
+	if err == nil && p.Confirm != nil && p.Mode&MODE_VERIFY == 0 {
+		err = errors.New("peer did not use SAS confirmation")
+	}
+	if err == nil && p.Identity != nil && p.Mode&MODE_IDENTITY == 0 {
+		err = errors.New("peer did not use identity key")
+	}
+	if err == nil && p.refuse != nil {
+		err = p.refuse
+	}
+
+	// 2. Pick cipher and compression
+	if utp1 {
+		p.cipher, p.comp, p.caps = CIPHER_GCM1, COMP_NONE, nil
+		return err
+	}
+	p.cipher = pickCap(uint16(Opsec.DecodeInt(peerCaps[2:4])), p.ciphers())
+	comps := p.comps()
+	if p.cipher != CIPHER_GCMX1 { // whole body is not compressed
+		comps &^= COMP_DEFLATE
+	}
+	p.comp = pickCap(uint16(Opsec.DecodeInt(peerCaps[4:6])), comps)
+	if err == nil && p.cipher == 0 {
+		err = errors.New("no common cipher")
+	}
+	if err == nil && p.comp == 0 {
+		err = errors.New("no common compression")
+	}
+
+	// 3. Reject with reason
+	if err != nil {
+		p.rejectHello(err)
+		return err
+	}
+	p.caps = append(slices.Clone(peerCaps), Opsec.EncodeInt(uint64(p.cipher), 2)...)
+	p.caps = append(p.caps, Opsec.EncodeInt(uint64(p.comp), 2)...)
+	return nil
+}
+
+// reject hello of UTP2 sender: Magic(4) "UTPE" + Size(2) + Reason
+func (p *TPprotocol) rejectHello(err error) {
+	reason := []byte(err.Error())
+	p.conn.Write(append(append([]byte("UTPE"), Opsec.EncodeInt(uint64(len(reason)), 2)...), reason...))
+}
+
+// sender reads UTP2 accept: Magic(4) + Mode(2) + Cipher(2) + Comp(2), or reject
+func (p *TPprotocol) readAccept() error {
+	head := make([]byte, 6)
+	if _, err := io.ReadFull(p.conn, head); err != nil {
+		return err
+	}
+	switch string(head[:4]) {
+	case "UTPE":
+		reason := make([]byte, Opsec.DecodeInt(head[4:6]))
+		if _, err := io.ReadFull(p.conn, reason); err != nil {
+			return err
+		}
+		return errors.New("handshake rejected by receiver: " + string(reason))
+	case "UTP2":
+	default:
+		return errors.New("invalid magic number")
+	}
+	if uint16(Opsec.DecodeInt(head[4:6])) != p.Mode {
+		return errors.New("mode changed by receiver")
+	}
+	if _, err := io.ReadFull(p.conn, head[:4]); err != nil {
+		return err
+	}
+	p.cipher = uint16(Opsec.DecodeInt(head[0:2]))
+	p.comp = uint16(Opsec.DecodeInt(head[2:4]))
+	if !validCap(p.cipher, p.ciphers()) || !validCap(p.comp, p.comps()) {
+		return errors.New("invalid capability from receiver")
+	}
+	if p.comp == COMP_DEFLATE && p.cipher != CIPHER_GCMX1 {
+		return errors.New("compression needs chunked cipher")
+	}
+	p.caps = append(p.caps, head[:4]...)
+	return nil
+}
+
+// handshake transcript: Magic(4) + Mode(2) + Capabilities + [PubSize(2) + PubKey] x2 + TransferID
+func (p *TPprotocol) transcript(senderPub []byte, receiverPub []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(p.magic[:])
+	buf.Write(Opsec.EncodeInt(uint64(p.Mode), 2))
+	buf.Write(p.caps)
+	buf.Write(Opsec.EncodeInt(uint64(len(senderPub)), 2))
+	buf.Write(senderPub)
+	buf.Write(Opsec.EncodeInt(uint64(len(receiverPub)), 2))
+	buf.Write(receiverPub)
+	buf.Write(p.TransferID)
+	if p.Mode&MODE_MULTI != 0 {
+		buf.Write([]byte{byte(p.nstreams[0]), byte(p.nstreams[1])})
+	}
+	return buf.Bytes()
+}
+
+// commitment to sender key in hello of SAS session
+func sasCommit(pub []byte) []byte {
+	return Bencrypt.Sha3256(append([]byte("AFT_SAS_COMMIT"), pub...))
+}
+
+// short authentication string, returns (4 words, 6 digits)
+func (p *TPprotocol) sas(senderPub []byte, receiverPub []byte) (string, string) {
+	h := Bencrypt.Sha3256(p.transcript(senderPub, receiverPub))
+	words := make([]string, 4)
+	for i := range words {
+		words[i] = wordList[h[i]]
+	}
+	n := Opsec.DecodeInt(h[4:8]) % 1000000
+	return strings.Join(words, "-"), fmt.Sprintf("%03d %03d", n/1000, n%1000)
+}
+
+// make one-time pairing code like 7-crossbow-tulip
+func NewPairCode() string {
+	r := Bencrypt.Random(3)
+	return fmt.Sprintf("%d-%s-%s", 1+int(r[0])%99, wordList[r[1]], wordList[r[2]])
+}
+
+// CPace on ristretto255 bound to handshake transcript, wrong code fails at key confirmation
+func (p *TPprotocol) pake(senderPub []byte, receiverPub []byte, isSender bool) error {
+	// 1. Make generator from code and transcript, exchange Element(32)
+	code := strings.Join(strings.Fields(strings.ToLower(strings.ReplaceAll(p.Code, "-", " "))), "-")
+	noCode := code == ""
+	if noCode { // finish exchange so that peer fails cleanly
+		code = hex.EncodeToString(Bencrypt.Random(16))
+	}
+	sid := Bencrypt.Sha3256(p.transcript(senderPub, receiverPub))
+	g := group.Ristretto255
+	gen := g.HashToElement(append([]byte(code), sid...), []byte("AFT_PAKE_CPACE1"))
+	x := g.RandomNonZeroScalar(rand.Reader)
+	myElem, err := g.NewElement().Mul(gen, x).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err := p.conn.Write(myElem); err != nil {
+		return err
+	}
+	peerElem := make([]byte, len(myElem))
+	if _, err := io.ReadFull(p.conn, peerElem); err != nil {
+		return err
+	}
+	y := g.NewElement()
+	if err := y.UnmarshalBinary(peerElem); err != nil || y.IsIdentity() {
+		return errors.New("invalid pairing message")
+	}
+
+	// 2. Derive shared secret: K + sid + SenderElem + ReceiverElem
+	k, err := g.NewElement().Mul(y, x).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	secret := append(k, sid...)
+	if isSender {
+		secret = append(append(secret, myElem...), peerElem...)
+	} else {
+		secret = append(append(secret, peerElem...), myElem...)
+	}
+
+	// 3. Exchange key confirmation MAC(32)
+	sMac, err := Bencrypt.Genkey(secret, "PAKE_CONFIRM_SENDER", 32)
+	if err != nil {
+		return err
+	}
+	rMac, err := Bencrypt.Genkey(secret, "PAKE_CONFIRM_RECEIVER", 32)
+	if err != nil {
+		return err
+	}
+	myMac, expMac := rMac, sMac
+	if isSender {
+		myMac, expMac = sMac, rMac
+	}
+	if _, err := p.conn.Write(myMac); err != nil {
+		return err
+	}
+	peerMac := make([]byte, 32)
+	if _, err := io.ReadFull(p.conn, peerMac); err != nil {
+		return err
+	}
+	if noCode {
+		return errors.New("pairing code is required")
+	}
+	if !hmac.Equal(peerMac, expMac) {
+		return ErrPairCode
+	}
+	return nil
+}
+
+// sign transcript with identity key, check peer identity with trusted peers
+func (p *TPprotocol) identify(senderPub []byte, receiverPub []byte, isSender bool) error {
+	// 1. Send NameSize(2) + Name + IdPubSize(2) + IdPub + SignSize(2) + Sign, empty if no identity
+	myLbl, peerLbl := "AFT_ID_RECEIVER", "AFT_ID_SENDER"
+	if isSender {
+		myLbl, peerLbl = peerLbl, myLbl
+	}
+	tr := p.transcript(senderPub, receiverPub)
+	var name, pub, sign []byte
+	if p.Identity != nil {
+		e := new(Bencrypt.ECC1)
+		if err := e.Loadkey(nil, p.Identity.Private); err != nil {
+			return err
+		}
+		var err error
+		if sign, err = e.Sign(append([]byte(myLbl), tr...)); err != nil {
+			return err
+		}
+		name, pub = []byte(p.Identity.Name), p.Identity.Public
+	}
+	var buf bytes.Buffer
+	for _, v := range [][]byte{name, pub, sign} {
+		if len(v) > 65535 {
+			return errors.New("identity is too long")
+		}
+		buf.Write(Opsec.EncodeInt(uint64(len(v)), 2))
+		buf.Write(v)
+	}
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if p.Identity == nil {
+		return errors.New("identity key is required")
+	}
+
+	// 2. Receive peer identity
+	fields := make([][]byte, 3)
+	for i := range fields {
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(p.conn, head); err != nil {
+			return err
+		}
+		if size := Opsec.DecodeInt(head); size > uint64(p.keyLimit()) {
+			return &PolicyError{Field: "key", Size: int64(size), Limit: int64(p.keyLimit())}
+		}
+		fields[i] = make([]byte, Opsec.DecodeInt(head))
+		if _, err := io.ReadFull(p.conn, fields[i]); err != nil {
+			return err
+		}
+	}
+	if len(fields[1]) == 0 {
+		return errors.New("peer has no identity key")
+	}
+	e := new(Bencrypt.ECC1)
+	if err := e.Loadkey(fields[1], nil); err != nil {
+		return err
+	}
+	if !e.Verify(append([]byte(peerLbl), tr...), fields[2]) {
+		return errors.New("peer identity signature verification failed")
+	}
+	p.PeerName, p.PeerID = string(fields[0]), fields[1]
+
+	// 3. Check trusted peers, add new peer if accepted
+	status := PEER_NEW
+	if p.Peers != nil {
+		status = p.Peers.Check(p.PeerName, p.PeerID)
+	}
+	p.trusted = status == PEER_TRUSTED
+	ok := p.trusted // new peers need explicit Trust
+	if p.Trust != nil {
+		ok = p.Trust(p.PeerName, Fingerprint(p.PeerID), status)
+	}
+	if !ok && status == PEER_CHANGED {
+		return errors.New("identity of peer has changed: " + p.PeerName)
+	} else if !ok {
+		return errors.New("peer identity rejected: " + p.PeerName)
+	}
+	if status == PEER_NEW && p.Peers != nil {
+		if err := p.Peers.Add(p.PeerName, p.PeerID); err != nil {
+			return err
+		}
+		return p.Peers.Store()
+	}
+	return nil
+}
+
+// confirm SAS with user, exchange verdict with peer: zero8, or error frame sent by halt
+func (p *TPprotocol) verify(senderPub []byte, receiverPub []byte) error {
+	if p.Confirm == nil {
+		return errors.New("SAS confirmation is not available")
+	} else if !p.Confirm(p.sas(senderPub, receiverPub)) {
+		return errors.New("SAS rejected by user")
+	}
+	if _, err := p.conn.Write(p.zero8[:]); err != nil {
+		return err
+	}
+	var peer [8]byte
+	if _, err := io.ReadFull(p.conn, peer[:1]); err != nil {
+		return err
+	}
+	if typ := peer[0]; isErrorFrame(typ) { // receiver failed, no max8 first
+		if _, err := io.ReadFull(p.conn, peer[:4]); err != nil {
+			return err
+		}
+		return p.readError(p.conn, typ, Opsec.DecodeInt(peer[:4]))
+	}
+	if _, err := io.ReadFull(p.conn, peer[1:]); err != nil {
+		return err
+	}
+	if peer == p.max8 {
+		return p.readFailure(errors.New("SAS rejected by peer"))
+	} else if peer != p.zero8 {
+		return errors.New("SAS rejected by peer")
+	}
+	return nil
+}
+
+// public key algorithm of session keys
+func (p *TPprotocol) headAlgo() string {
+	if p.Mode&MODE_LEGACY != 0 {
+		return "rsa1"
+	} else if p.Mode&MODE_PQ != 0 {
+		return "pqc1"
+	}
+	return "ecc1"
+}
+
+// pqc1 hybrid key pair: EccSize(2) + ECC1 key + X-Wing key (ML-KEM-768 + X25519)
+func genHybrid() ([]byte, []byte, error) {
+	eccPub, eccPriv, err := new(Bencrypt.ECC1).Genkey()
+	if err != nil {
+		return nil, nil, err
+	}
+	kemPriv, kemPub, err := xwing.GenerateKeyPairPacked(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return joinHybrid(eccPub, kemPub), joinHybrid(eccPriv, kemPriv), nil
+}
+
+func joinHybrid(ecc []byte, kem []byte) []byte {
+	return append(append(Opsec.EncodeInt(uint64(len(ecc)), 2), ecc...), kem...)
+}
+
+// returns (ECC1 key, X-Wing key), nil key is kept nil
+func splitHybrid(key []byte) ([]byte, []byte, error) {
+	if key == nil {
+		return nil, nil, nil
+	}
+	if len(key) < 2 || int(Opsec.DecodeInt(key[:2])) > len(key)-2 {
+		return nil, nil, errors.New("invalid hybrid key")
+	}
+	size := int(Opsec.DecodeInt(key[:2]))
+	return key[2 : 2+size], key[2+size:], nil
+}
+
+// opsec header by public key, pqc1 is ecc1 header with X-Wing ciphertext in Msg mixed into body key
+func encpub(ops *Opsec.Opsec, algo string, public []byte, private []byte) ([]byte, error) {
+	if algo != "pqc1" {
+		return ops.Encpub(algo, public, private)
+	}
+	eccPub, kemPub, err := splitHybrid(public)
+	if err != nil {
+		return nil, err
+	}
+	eccPriv, _, err := splitHybrid(private)
+	if err != nil {
+		return nil, err
+	}
+	if len(kemPub) != xwing.PublicKeySize || ops.Size < 0 {
+		return nil, errors.New("invalid hybrid key")
+	}
+	ss, ct, err := xwing.Encapsulate(kemPub, nil)
+	if err != nil {
+		return nil, err
+	}
+	ops.Msg = string(ct)
+	head, err := ops.Encpub("ecc1", eccPub, eccPriv)
+	if err != nil {
+		return nil, err
+	}
+	ops.BodyKey, err = Bencrypt.Genkey(append(ops.BodyKey, ss...), "AFT_PQC1_BODY", 44)
+	return head, err
+}
+
+// parse opsec header, malformed config panics inside Opsec
+func view(ops *Opsec.Opsec, head []byte) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = errors.New("invalid opsec header")
+		}
+	}()
+	ops.View(head)
+	return nil
+}
+
+func decpub(ops *Opsec.Opsec, algo string, private []byte, public []byte) error {
+	if algo != "pqc1" {
+		return ops.Decpub(private, public)
+	}
+	eccPriv, kemPriv, err := splitHybrid(private)
+	if err != nil {
+		return err
+	}
+	eccPub, _, err := splitHybrid(public)
+	if err != nil {
+		return err
+	}
+	if len(kemPriv) != xwing.PrivateKeySize || len(ops.Msg) != xwing.CiphertextSize {
+		return errors.New("invalid hybrid header")
+	}
+	if err := ops.Decpub(eccPriv, eccPub); err != nil {
+		return err
+	}
+	if len(ops.BodyKey) == 0 {
+		return errors.New("invalid hybrid header")
+	}
+	ss := xwing.Decapsulate([]byte(ops.Msg), kemPriv)
+	ops.BodyKey, err = Bencrypt.Genkey(append(ops.BodyKey, ss...), "AFT_PQC1_BODY", 44)
+	return err
+}
+
+// gcmx1 chunk cipher, same layout as Bencrypt AES1.EnAESGCMx
+type chunkCipher struct {
+	aead cipher.AEAD
+	iv   []byte
+}
+
+func newChunkCipher(key []byte) (*chunkCipher, error) {
+	if len(key) != 44 {
+		return nil, errors.New("invalid body key")
+	}
+	block, err := aes.NewCipher(key[12:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{aead: aead, iv: key[:12]}, nil
+}
+
+// global IV xor counter (8B LE) at bytes 4~11
+func (c *chunkCipher) nonce(counter uint64) []byte {
+	iv := make([]byte, 12)
+	copy(iv, c.iv)
+	ctr := Opsec.EncodeInt(counter, 8)
+	for i := 0; i < 8; i++ {
+		iv[4+i] ^= ctr[i]
+	}
+	return iv
+}
+
+// encrypt chunk in place, plain must have 16B spare capacity
+func (c *chunkCipher) seal(plain []byte, counter uint64) []byte {
+	return c.aead.Seal(plain[:0], c.nonce(counter), plain, nil)
+}
+
+// decrypt chunk in place
+func (c *chunkCipher) open(enc []byte, counter uint64) ([]byte, error) {
+	return c.aead.Open(enc[:0], c.nonce(counter), enc, nil)
+}
+
+// COMP_DEFLATE of gcmx1 chunks, plain chunk is Flag(1) + Data, flag 0 is stored, 1 is deflated
+type chunkZip struct {
+	buf    bytes.Buffer
+	zw     *flate.Writer
+	zr     io.ReadCloser
+	out    []byte
+	stored bool // name of already compressed format
+	skip   int  // chunks stored without trying after incompressible one
+}
+
+// extensions of already compressed formats
+var storedExts = map[string]bool{
+	".7z": true, ".avif": true, ".br": true, ".bz2": true, ".docx": true, ".flac": true, ".gif": true, ".gz": true,
+	".heic": true, ".jar": true, ".jpeg": true, ".jpg": true, ".m4a": true, ".mkv": true, ".mov": true, ".mp3": true,
+	".mp4": true, ".ogg": true, ".png": true, ".pptx": true, ".rar": true, ".tgz": true, ".webm": true, ".webp": true,
+	".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+func newChunkZip(name string) *chunkZip {
+	z := &chunkZip{stored: storedExts[strings.ToLower(path.Ext(name))]}
+	z.zw, _ = flate.NewWriter(&z.buf, flate.BestSpeed)
+	z.zr = flate.NewReader(bytes.NewReader(nil))
+	return z
+}
+
+// compress plain[1:] in place and set flag, returns plain or shorter slice of it
+func (z *chunkZip) pack(plain []byte) []byte {
+	plain[0] = 0
+	raw := plain[1:]
+	if z.stored || len(raw) == 0 {
+		return plain
+	}
+	if z.skip > 0 {
+		z.skip--
+		return plain
+	}
+	z.buf.Reset()
+	z.zw.Reset(&z.buf)
+	z.zw.Write(raw)
+	z.zw.Close()
+	if z.buf.Len() >= len(raw)-len(raw)/32 { // saves less than 3%, likely media or archive
+		z.skip = 16
+		return plain
+	}
+	plain[0] = 1
+	return plain[:1+copy(raw, z.buf.Bytes())]
+}
+
+// restore chunk of size bytes from plain
+func (z *chunkZip) unpack(plain []byte, size int) ([]byte, error) {
+	if len(plain) == 0 {
+		return nil, errors.New("invalid chunk")
+	}
+	switch plain[0] {
+	case 0:
+		if len(plain)-1 != size {
+			return nil, errors.New("invalid chunk size")
+		}
+		return plain[1:], nil
+	case 1:
+		if len(z.out) < size+1 {
+			z.out = make([]byte, size+1)
+		}
+		z.zr.(flate.Resetter).Reset(bytes.NewReader(plain[1:]), nil)
+		n, err := io.ReadFull(z.zr, z.out[:size+1]) // one more byte to catch overlong data
+		if n != size || err != io.ErrUnexpectedEOF {
+			return nil, errors.New("invalid compressed chunk")
+		}
+		return z.out[:size], nil
+	default:
+		return nil, errors.New("unknown chunk flag")
+	}
+}
+
+// frame of pipeline, data is slice of free buffer
+type pipeFrame struct {
+	data []byte
+	err  error
+}
+
+// run fill for count frames in goroutine, up to depth frames ahead of consumer.
+// consumer puts data back to free after use, halt stops and waits for goroutine
+func pipeline(count int64, depth int, size int, fill func(i int64, buf []byte) ([]byte, error)) (<-chan pipeFrame, chan<- []byte, func()) {
+	frames := make(chan pipeFrame, depth)
+	free := make(chan []byte, depth+1)
+	for range depth {
+		free <- make([]byte, size)
+	}
+	quit := make(chan bool)
+	exited := make(chan bool)
+	go func() {
+		defer close(exited)
+		for i := int64(0); i < count; i++ {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-quit:
+				return
+			}
+			data, err := fill(i, buf[:cap(buf)])
+			select {
+			case frames <- pipeFrame{data: data, err: err}:
+			case <-quit:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return frames, free, func() {
+		once.Do(func() {
+			close(quit)
+			<-exited
+		})
+	}
+}
+
+// extra body connections of running transfer
+func (p *TPprotocol) extraStreams() []*activeConn {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.streams) < 2 {
+		return nil
+	}
+	return slices.Clone(p.streams[1:])
+}
+
+// session can continue a partial file: identity proves same peer, gcmx1 carries file hash
+func (p *TPprotocol) resumable() bool {
+	return p.Mode&MODE_RESUME != 0 && p.Mode&MODE_IDENTITY != 0 && p.cipher == CIPHER_GCMX1
+}
+
+// receive whole file hash frame sealed after last chunk
+func (p *TPprotocol) receiveDigest(c *chunkCipher, counter uint64) ([]byte, error) {
+	frame := make([]byte, DIGEST_FRAME)
+	if err := p.recv(frame[:5]); err != nil {
+		return nil, err
+	}
+	if isErrorFrame(frame[0]) {
+		return nil, p.readError(p.conn, frame[0], Opsec.DecodeInt(frame[1:5]))
+	}
+	if frame[0] != FRAME_DATA || Opsec.DecodeInt(frame[1:5]) != DIGEST_FRAME-5 {
+		return nil, errors.New("invalid frame")
+	}
+	if err := p.recv(frame[5:]); err != nil {
+		return nil, err
+	}
+	sum, err := c.open(frame[5:], counter)
+	if err != nil {
+		p.report(ERROR_DECRYPT, err)
+		return nil, err
+	}
+	return sum, nil
+}
+
+// one writer goroutine per stream, slow connection does not hold frames of others
+type streamWriters struct {
+	queues []chan []byte
+	failed chan error
+	quit   chan bool
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+// start writers of all streams, written frames go back to free
+func (p *TPprotocol) startWriters(free chan<- []byte) *streamWriters {
+	n := max(p.nstreams[1], 1)
+	w := &streamWriters{queues: make([]chan []byte, n), failed: make(chan error, n), quit: make(chan bool)}
+	for k := range w.queues {
+		w.queues[k] = make(chan []byte, PIPE_DEPTH)
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for data := range w.queues[k] {
+				select {
+				case <-w.quit: // stop after whole frame
+					return
+				default:
+				}
+				if err := p.sendTo(p.stream(int64(k)), data); err != nil {
+					w.failed <- err
+					return
+				}
+				free <- data
+			}
+		}()
+	}
+	return w
+}
+
+// queue frame i to writer of its stream, fails with first write error
+func (w *streamWriters) send(i int64, data []byte) error {
+	select {
+	case w.queues[i%int64(len(w.queues))] <- data:
+		return nil
+	case err := <-w.failed:
+		w.failed <- err
+		return err
+	}
+}
+
+// wait until queued frames are written
+func (w *streamWriters) wait() error {
+	w.once.Do(func() {
+		for _, q := range w.queues {
+			close(q)
+		}
+	})
+	w.wg.Wait()
+	select {
+	case err := <-w.failed:
+		w.failed <- err
+		return err
+	default:
+		return nil
+	}
+}
+
+// stop writers after frames being written, queued ones are dropped
+func (w *streamWriters) halt() {
+	select {
+	case <-w.quit:
+	default:
+		close(w.quit)
+	}
+	w.wait()
+}
+
+// connection of chunk i, round robin
+func (p *TPprotocol) stream(i int64) *activeConn {
+	if len(p.streams) < 2 {
+		return p.conn
+	}
+	return p.streams[i%int64(len(p.streams))]
+}
+
+// proves extra connection belongs to transfer, derived from body key
+func streamToken(key []byte, index int) ([]byte, error) {
+	return Bencrypt.Genkey(append(slices.Clone(key), byte(index)), "AFT_STREAM_TOKEN", 32)
+}
+
+// sender opens extra connections: Magic(4) "UTPS" + Index(1) + Token(32)
+func (p *TPprotocol) openStreams(key []byte) error {
+	streams := []*activeConn{p.conn}
+	defer func() {
+		p.lock.Lock()
+		p.streams = streams
+		p.lock.Unlock()
+	}()
+	for i := 1; i < p.nstreams[1]; i++ {
+		conn, err := p.StreamDial()
+		if err != nil {
+			return err
+		}
+		c := &activeConn{Conn: conn, last: p.conn.last}
+		streams = append(streams, c)
+		token, err := streamToken(key, i)
+		if err != nil {
+			return err
+		}
+		if _, err := c.Write(append(append([]byte("UTPS"), byte(i)), token...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiver takes extra connections, drops ones with wrong token, waits 10s at most
+func (p *TPprotocol) acceptStreams(key []byte) error {
+	type hello struct {
+		idx  int
+		conn net.Conn
+	}
+	streams := make([]*activeConn, p.nstreams[1])
+	streams[0] = p.conn
+	defer func() {
+		p.lock.Lock()
+		p.streams = slices.DeleteFunc(streams, func(c *activeConn) bool { return c == nil })
+		p.lock.Unlock()
+	}()
+
+	// 1. Accept until all streams are here, at most STREAM_MAX hellos pending
+	ctx, cancel := context.WithTimeout(p.ctx, 10*time.Second) // all streams share deadline
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	pending := make(chan bool, STREAM_MAX)
+	ready := make(chan hello)
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case pending <- true:
+			case <-ctx.Done():
+				return
+			}
+			conn, err := p.StreamAccept()
+			if err != nil {
+				failed <- err
+				return
+			}
+			if ctx.Err() != nil { // accepted too late
+				conn.Close()
+				return
+			}
+
+			// 2. Read hellos concurrently, slow peer does not hold others
+			go func() {
+				defer func() { <-pending }()
+				buf := make([]byte, 37)
+				conn.SetReadDeadline(deadline)
+				unblock := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+				_, err := io.ReadFull(conn, buf)
+				unblock()
+				conn.SetReadDeadline(time.Time{})
+				idx := int(buf[4])
+				token, terr := streamToken(key, idx)
+				if err != nil || terr != nil || string(buf[:4]) != "UTPS" || idx < 1 || idx >= len(streams) || !hmac.Equal(buf[5:], token) {
+					conn.Close()
+					return
+				}
+				select {
+				case ready <- hello{idx, conn}:
+				case <-ctx.Done():
+					conn.Close()
+				}
+			}()
+		}
+	}()
+
+	// 3. Collect streams until all are here
+	for n := 1; n < len(streams); {
+		select {
+		case h := <-ready:
+			if streams[h.idx] != nil { // duplicate index
+				h.conn.Close()
+				continue
+			}
+			streams[h.idx] = &activeConn{Conn: h.conn, last: p.conn.last}
+			n++
+		case err := <-failed:
+			return err
+		case <-ctx.Done():
+			if p.ctx.Err() != nil {
+				return context.Cause(p.ctx)
+			}
+			return errors.New("extra stream connection timeout")
+		}
+	}
+	return nil
+}
+
+// close extra connections after body
+func (p *TPprotocol) closeStreams() {
+	for _, c := range p.extraStreams() {
+		c.Close()
+	}
+	p.lock.Lock()
+	p.streams = nil
+	p.lock.Unlock()
+}
+
+// number of gcmx1 chunks for plain size, empty data is one chunk
+func chunkCount(size int64) int64 {
+	if size <= 0 {
+		return 1
+	}
+	return (size + int64(CHUNK_SIZE) - 1) / int64(CHUNK_SIZE)
+}
+
+// Send memory data, public key is [from, to]
+func (p *TPprotocol) SendData(data []byte, smsg string) ([]byte, []byte, error) {
+	return p.SendDataContext(context.Background(), data, smsg)
+}
+
+// SendData aborted when ctx is done
+func (p *TPprotocol) SendDataContext(ctx context.Context, data []byte, smsg string) ([]byte, []byte, error) {
+	return p.SendStreamContext(ctx, bytes.NewReader(data), int64(len(data)), smsg)
+}
+
+// Receive to memory data, public key is [from, to]
+func (p *TPprotocol) ReceiveData() ([]byte, []byte, []byte, string, error) {
+	return p.ReceiveDataContext(context.Background())
+}
+
+// ReceiveData aborted when ctx is done
+func (p *TPprotocol) ReceiveDataContext(ctx context.Context) ([]byte, []byte, []byte, string, error) {
+	var buf bytes.Buffer
+	p.memory = true
+	defer func() { p.memory = false }()
+	peerPub, myPub, smsg, err := p.ReceiveStreamContext(ctx, &buf)
+	if err != nil {
+		return peerPub, myPub, nil, smsg, err
+	}
+	return peerPub, myPub, buf.Bytes(), smsg, nil
+}
+
+// Send size bytes from stream, public key is [from, to]
+func (p *TPprotocol) SendStream(r io.Reader, size int64, smsg string) ([]byte, []byte, error) {
+	return p.SendStreamContext(context.Background(), r, size, smsg)
+}
+
+// SendStream aborted when ctx is done
+func (p *TPprotocol) SendStreamContext(ctx context.Context, r io.Reader, size int64, smsg string) ([]byte, []byte, error) {
+	end := p.begin(ctx)
+	defer end()
+	myPub, peerPub, err := p.sendStream(r, size, smsg)
+	err = p.cause(err)
+	return myPub, peerPub, p.record("send", p.OfferName, peerPub, smsg, err)
+}
+
+func (p *TPprotocol) sendStream(r io.Reader, size int64, smsg string) ([]byte, []byte, error) {
+	// 1. Handshake
+	p.setStage(STAGE_HANDSHAKE)
+	peerPub, myPub, myPriv, err := p.handshakeSend()
+	if err != nil {
+		p.setStage(STAGE_ERROR)
+		return myPub, peerPub, err
+	}
+
+	// 2. Skip data acked by receiver
+	if p.Mode&MODE_MSGONLY != 0 {
+		p.setStage(STAGE_ERROR)
+		return myPub, peerPub, errors.New("use OpenMessages with MODE_MSGONLY")
+	}
+	if p.offset > uint64(max(size, 0)) {
+		p.setStage(STAGE_ERROR)
+		return myPub, peerPub, errors.New("invalid resume offset")
+	}
+	if p.resumable() { // hash skipped data too, receiver checks whole file
+		p.digest = sha3.New256()
+	}
+	if p.offset > 0 {
+		if sk, ok := r.(io.Seeker); ok && p.digest == nil {
+			_, err = sk.Seek(int64(p.offset), io.SeekCurrent)
+		} else if p.digest != nil {
+			_, err = io.CopyN(p.digest, r, int64(p.offset))
+		} else {
+			_, err = io.CopyN(io.Discard, r, int64(p.offset))
+		}
+		if err != nil {
+			p.setStage(STAGE_ERROR)
+			return myPub, peerPub, err
+		}
+		size -= int64(p.offset)
+	}
+	return myPub, peerPub, p.sendBody(r, size, smsg, peerPub, myPriv)
 }
 
-// Send memory data, public key is [from, to]
-func (p *TPprotocol) SendData(data []byte, smsg string) ([]byte, []byte, error) {
-	// 1. Handshake
-	p.setStage(STAGE_HANDSHAKE)
-	peerPub, myPub, myPriv, err := p.handshakeSend()
-	if err != nil {
-		return myPub, peerPub, err
+// send opsec header and framed body after handshake
+func (p *TPprotocol) sendBody(r io.Reader, size int64, smsg string, peerPub []byte, myPriv []byte) error {
+	if p.tally != nil {
+		r = io.TeeReader(r, p.tally)
+	}
+	if p.resumable() {
+		if p.digest == nil {
+			p.digest = sha3.New256()
+		}
+		r = io.TeeReader(r, p.digest)
+	}
+
+	// read offer verdict and termination from receiver while sending
+	offer := string(p.magic[:]) == "UTP2"
+	verdict := make(chan error, 1)
+	back := make(chan error, 1)
+	go func() {
+		var err error
+		if offer {
+			err = p.readTerm()
+			verdict <- err
+		}
+		if err == nil {
+			err = p.readTerm()
+		}
+		if fromPeer(err) {
+			p.cancel(err)
+		}
+		back <- err
+	}()
+	fail := func(err error) error {
+		p.setStage(STAGE_ERROR)
+		p.conn.SetReadDeadline(time.Now())
+		<-back
+		return err
 	}
-	stop := make(chan bool)
+	stop := make(chan error)
 	go p.syncStatus(stop)
 
-	// 2. Make Opsec Header
+	// 1. Make Opsec Header
 	p.setStage(STAGE_ENCRYPTING)
+	if size < 0 {
+		err := errors.New("invalid stream size")
+		stop <- err
+		return fail(err)
+	}
+	chunks := chunkCount(size)
 	ops := new(Opsec.Opsec)
 	ops.Reset()
-	ops.Size = int64(len(data)) + 16 // data + tag
-	ops.BodyAlgo = "gcm1"
+	ops.Size = size + 16*chunks // data + tag per chunk
+	ops.BodyAlgo = "gcmx1"
 	ops.Smsg = smsg
-
-	var opsHead []byte
-	if p.Mode&MODE_LEGACY != 0 {
-		opsHead, err = ops.Encpub("rsa1", peerPub, myPriv)
-	} else {
-		opsHead, err = ops.Encpub("ecc1", peerPub, myPriv)
-	}
-	if err != nil {
-		p.setStage(STAGE_ERROR)
-		stop <- false
-		return myPub, peerPub, err
+	ops.Name = p.OfferName
+	ops.ContAlgo = p.OfferType
+	if p.cipher == CIPHER_GCM1 { // whole body for UTP1 peers
+		chunks = 0
+		ops.Size = size + 16
+		ops.BodyAlgo = "gcm1"
 	}
 
-	// 3. Encrypt body
-	aes := new(Bencrypt.AES1)
-	var key [44]byte
-	copy(key[:], ops.BodyKey)
-	encBody, err := aes.EnAESGCM(key, data)
+	opsHead, err := encpub(ops, p.headAlgo(), peerPub, myPriv)
 	if err != nil {
-		p.setStage(STAGE_ERROR)
-		stop <- false
-		return myPub, peerPub, err
+		stop <- err
+		return fail(err)
 	}
-
-	// 4. Build Payload with Framing
 	var headerBuf bytes.Buffer
 	if err := ops.Write(&headerBuf, opsHead); err != nil {
-		p.setStage(STAGE_ERROR)
-		stop <- false
-		return myPub, peerPub, err
+		stop <- err
+		return fail(err)
+	}
+	c, err := newChunkCipher(ops.BodyKey)
+	if err != nil {
+		stop <- err
+		return fail(err)
+	}
+	var encBody []byte
+	if p.cipher == CIPHER_GCM1 {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			stop <- err
+			return fail(err)
+		}
+		var key [44]byte
+		copy(key[:], ops.BodyKey)
+		if encBody, err = new(Bencrypt.AES1).EnAESGCM(key, data); err != nil {
+			stop <- err
+			return fail(err)
+		}
 	}
-	payload := append(headerBuf.Bytes(), encBody...)
-	encBody = nil
-	totalSize := uint64(len(payload))
-	stop <- true
+	if p.ctx.Err() != nil {
+		err := context.Cause(p.ctx)
+		stop <- err
+		return fail(err)
+	}
+	stop <- nil
 	p.setStage(STAGE_TRANSFERRING)
 
-	// 5. send total size
-	p.setSent(0)
+	// 2. send total size (Header + Frames), header
+	head := 5 // frame header, plus chunk flag with compression
+	if p.comp == COMP_DEFLATE {
+		head = 6
+	}
+	totalSize := uint64(headerBuf.Len()) + uint64(ops.Size) + uint64(head)*uint64(chunks)
+	if p.resumable() {
+		totalSize += DIGEST_FRAME
+	}
 	p.setTotal(totalSize)
 	if _, err := p.conn.Write(Opsec.EncodeInt(totalSize, 8)); err != nil {
-		p.setStage(STAGE_ERROR)
-		return myPub, peerPub, err
+		return fail(err)
+	}
+	if err := p.send(headerBuf.Bytes()); err != nil {
+		return fail(err)
+	}
+	if offer { // wait until receiver accepts header as offer
+		p.setStage(STAGE_OFFER)
+		if err := <-verdict; err != nil {
+			if p.ctx.Err() != nil && !fromPeer(err) && chunks > 0 {
+				p.abort(context.Cause(p.ctx), false)
+			}
+			return fail(err)
+		}
+		p.setStage(STAGE_TRANSFERRING)
+	}
+	if err := p.send(encBody); err != nil { // gcm1 body
+		return fail(err)
+	}
+	if p.nstreams[1] > 1 {
+		defer p.closeStreams()
+		if err := p.openStreams(ops.BodyKey); err != nil {
+			return fail(err)
+		}
 	}
 
-	// 6. send payload
-	var currentSent uint64 = 0
-	for currentSent < totalSize {
-		n, err := p.conn.Write(payload[currentSent:min(currentSent+1024, totalSize)])
-		if err != nil {
-			p.setStage(STAGE_ERROR)
-			return myPub, peerPub, err
+	// 3. read, compress and encrypt next chunks while sending: Type(1) + Size(4) + EncChunk(N)
+	var zip *chunkZip
+	if p.comp == COMP_DEFLATE {
+		zip = newChunkZip(p.OfferName)
+	}
+	depth := PIPE_DEPTH + p.nstreams[1] - 1 // one more frame in flight per extra stream
+	frames, free, halt := pipeline(chunks, depth, 6+CHUNK_SIZE+16, func(i int64, frame []byte) ([]byte, error) {
+		n := int(min(size-i*int64(CHUNK_SIZE), int64(CHUNK_SIZE)))
+		if _, err := io.ReadFull(r, frame[head:head+n]); err != nil {
+			return nil, err
+		}
+		plain := frame[5 : head+n]
+		if zip != nil {
+			plain = zip.pack(plain)
+		}
+		enc := c.seal(plain, uint64(i))
+		frame[0] = FRAME_DATA
+		copy(frame[1:5], Opsec.EncodeInt(uint64(len(enc)), 4))
+		return frame[:5+len(enc)], nil
+	})
+	defer halt()
+	w := p.startWriters(free)
+	defer w.halt()
+	for i := int64(0); i < chunks; i++ {
+		if p.ctx.Err() != nil { // abort between frames
+			err := context.Cause(p.ctx)
+			w.halt()
+			if !fromPeer(err) {
+				p.abort(err, false)
+			}
+			return fail(err)
+		}
+		f := <-frames
+		if f.err != nil { // source failed, tell receiver after sent frames, they can be resumed
+			w.wait()
+			p.abort(f.err, false)
+			return fail(f.err)
+		}
+		p.addSaved(head + int(min(size-i*int64(CHUNK_SIZE), int64(CHUNK_SIZE))) + 16 - len(f.data))
+		if err := w.send(i, f.data); err != nil {
+			return fail(err)
+		}
+	}
+	if err := w.wait(); err != nil {
+		return fail(err)
+	}
+	if p.resumable() { // whole file hash after last chunk: Type(1) + Size(4) + EncHash(48)
+		enc := c.seal(p.digest.Sum(nil), uint64(chunks))
+		frame := append([]byte{FRAME_DATA}, Opsec.EncodeInt(uint64(len(enc)), 4)...)
+		if err := p.send(append(frame, enc...)); err != nil {
+			return fail(err)
 		}
-		currentSent += uint64(n)
-		p.setSent(currentSent)
 	}
 
-	// 7. Receive Termination
-	var term [8]byte
-	if _, err := io.ReadFull(p.conn, term[:]); err != nil {
+	// 4. Receive Termination
+	if err := <-back; err != nil {
 		p.setStage(STAGE_ERROR)
-		return myPub, peerPub, err
+		return err
 	}
-	if term != p.zero8 {
+	p.setStage(STAGE_COMPLETE)
+	return nil
+}
+
+// Receive to stream, public key is [from, to]
+func (p *TPprotocol) ReceiveStream(w io.Writer) ([]byte, []byte, string, error) {
+	return p.ReceiveStreamContext(context.Background(), w)
+}
+
+// ReceiveStream aborted when ctx is done
+func (p *TPprotocol) ReceiveStreamContext(ctx context.Context, w io.Writer) ([]byte, []byte, string, error) {
+	end := p.begin(ctx)
+	defer end()
+	peerPub, myPub, smsg, err := p.receiveStream(w)
+	err = p.cause(err)
+	return peerPub, myPub, smsg, p.record("recv", p.offer.Name, peerPub, smsg, err)
+}
+
+func (p *TPprotocol) receiveStream(w io.Writer) ([]byte, []byte, string, error) {
+	// 1. Handshake
+	p.setStage(STAGE_HANDSHAKE)
+	peerPub, myPub, myPriv, err := p.handshakeReceive()
+	if err != nil {
 		p.setStage(STAGE_ERROR)
-		return myPub, peerPub, errors.New("abnormal termination signal")
+		return peerPub, myPub, "", err
 	}
-	p.setStage(STAGE_COMPLETE)
-	return myPub, peerPub, nil
+	smsg, err := p.receiveBody(w, peerPub, myPriv, nil)
+	return peerPub, myPub, smsg, err
 }
 
-// Receive to memory data, public key is [from, to]
-func (p *TPprotocol) ReceiveData() ([]byte, []byte, []byte, string, error) {
+// Receive to resumable partial file in store, returns (peer public key, my public key, file path, smsg)
+func (p *TPprotocol) ReceiveResume(store *TPresume) ([]byte, []byte, string, string, error) {
+	return p.ReceiveResumeContext(context.Background(), store)
+}
+
+// ReceiveResume aborted when ctx is done, partial file is kept
+func (p *TPprotocol) ReceiveResumeContext(ctx context.Context, store *TPresume) ([]byte, []byte, string, string, error) {
+	end := p.begin(ctx)
+	defer end()
+	peerPub, myPub, path, smsg, err := p.receiveResume(store)
+	err = p.cause(err)
+	return peerPub, myPub, path, smsg, p.record("recv", p.offer.Name, peerPub, smsg, err)
+}
+
+func (p *TPprotocol) receiveResume(store *TPresume) ([]byte, []byte, string, string, error) {
 	// 1. Handshake
 	p.setStage(STAGE_HANDSHAKE)
+	p.resume = store
 	peerPub, myPub, myPriv, err := p.handshakeReceive()
 	if err != nil {
 		p.setStage(STAGE_ERROR)
-		return peerPub, myPub, nil, "", err
+		return peerPub, myPub, "", "", err
+	}
+	if !p.resumable() { // sender cannot resume or prove identity, use one-time session
+		p.TransferID = Bencrypt.Random(16)
+	}
+
+	// 2. Check owner of session, open partial file at acked offset
+	path := store.path(p.TransferID, ".part")
+	if err := os.MkdirAll(store.Dir, 0755); err != nil {
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, "", "", err
+	}
+	if err := store.claim(p.TransferID, p.PeerID); err != nil {
+		p.report(ERROR_REJECTED, err)
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, "", "", err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, "", "", err
+	}
+	defer f.Close()
+	if err := f.Truncate(int64(p.offset)); err != nil {
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, "", "", err
+	}
+	if _, err := f.Seek(int64(p.offset), io.SeekStart); err != nil {
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, "", "", err
+	}
+
+	// 3. Receive body, keep partial file on error, drop it if whole file differs from sender
+	smsg, err := p.receiveBody(f, peerPub, myPriv, func() error {
+		if err := f.Close(); err != nil || p.sum == nil {
+			return err
+		}
+		if err := store.check(p.TransferID, p.sum); err != nil {
+			store.remove(p.TransferID)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return peerPub, myPub, "", smsg, err
+	}
+	done := store.path(p.TransferID, ".done")
+	os.Remove(store.path(p.TransferID, ".peer"))
+	if err := os.Rename(path, done); err != nil {
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, "", smsg, err
 	}
+	return peerPub, myPub, done, smsg, nil
+}
 
-	// 2. Wait for Status (Start Signal)
+// receive opsec header and body after handshake, returns smsg.
+// done completes the output before the sender is told of success, nil if w needs nothing
+func (p *TPprotocol) receiveBody(w io.Writer, peerPub []byte, myPriv []byte, done func() error) (string, error) {
+	// 1. Wait for Status (Start Signal)
+	if p.Mode&MODE_MSGONLY != 0 && !p.pulling {
+		p.setStage(STAGE_ERROR)
+		return "", errors.New("peer opened message session")
+	}
+	if p.tally != nil {
+		w = io.MultiWriter(w, p.tally)
+	}
 	p.setStage(STAGE_TRANSFERRING)
+	p.abortable = true
 	var buf8 [8]byte
 	var totalSize uint64
 	for {
 		if _, err := io.ReadFull(p.conn, buf8[:]); err != nil {
 			p.setStage(STAGE_ERROR)
-			return peerPub, myPub, nil, "", err
+			return "", err
 		}
 
 		if buf8 == p.zero8 {
 			continue // Still preparing
-		} else if buf8 == p.max8 {
+		} else if buf8 == p.max8 { // error frame follows, not from legacy sender
 			p.setStage(STAGE_ERROR)
-			return peerPub, myPub, nil, "", errors.New("remote error reported")
+			return "", p.readFailure(errors.New("remote error reported"))
 		} else {
 			totalSize = Opsec.DecodeInt(buf8[:])
 			p.setTotal(totalSize) // Total transmission size (Header + Body)
@@ -346,665 +2979,1095 @@ func (p *TPprotocol) ReceiveData() ([]byte, []byte, []byte, string, error) {
 		}
 	}
 
-	// 3. Receive All Data to Memory
-	payload := make([]byte, totalSize)
-	var currentReceived uint64 = 0
-	for currentReceived < totalSize {
-		n, err := p.conn.Read(payload[currentReceived:])
-		if n > 0 {
-			currentReceived += uint64(n)
-			p.setSent(currentReceived)
+	// 2. Parse & Decrypt Header
+	ops := new(Opsec.Opsec)
+	headBytes, err := ops.Read(statusReader{p}, 1) // header is at start, no skipping
+	if err != nil || headBytes == nil {
+		p.setStage(STAGE_ERROR)
+		return "", errors.New("invalid opsec header")
+	}
+	if err := view(ops, headBytes); err != nil {
+		p.setStage(STAGE_ERROR)
+		return "", err
+	}
+	if err := decpub(ops, p.headAlgo(), myPriv, peerPub); err != nil {
+		p.setStage(STAGE_ERROR)
+		return "", err
+	}
+	var key [44]byte
+	copy(key[:], ops.BodyKey)
+	_, headSize, _ := p.GetStatus()
+	if want := map[uint16]string{CIPHER_GCM1: "gcm1", CIPHER_GCMX1: "gcmx1"}[p.cipher]; ops.BodyAlgo != want {
+		p.setStage(STAGE_ERROR)
+		return "", errors.New("body algorithm is not negotiated: " + ops.BodyAlgo)
+	}
+
+	// 3. Accept offer before body, UTP1 sender can only be stopped
+	offer := TPoffer{Name: ops.Name, Size: ops.Size - 16, Type: ops.ContAlgo, Message: ops.Smsg}
+	if ops.BodyAlgo == "gcmx1" {
+		offer.Size -= 16 * ((ops.Size+int64(CHUNK_SIZE)+15)/int64(CHUNK_SIZE+16) - 1)
+	}
+	p.offer = offer
+	reason := ""
+	var perr error
+	if ops.Size < 16 || headSize > totalSize {
+		reason = "invalid body size"
+	} else if body := totalSize - headSize; (p.memory || ops.BodyAlgo == "gcm1") && (offer.Size > p.payloadLimit() || body > uint64(p.payloadLimit())) {
+		perr = &PolicyError{Field: "payload", Size: int64(min(body, uint64(math.MaxInt64))), Limit: p.payloadLimit()}
+		reason = perr.Error()
+	} else if p.MaxSize > 0 && offer.Size > p.MaxSize {
+		reason = fmt.Sprintf("size %d exceeds limit %d", offer.Size, p.MaxSize)
+	} else if p.Accept != nil {
+		p.setStage(STAGE_OFFER)
+		if !p.Accept(offer) {
+			reason = "declined by user"
+		}
+		p.setStage(STAGE_TRANSFERRING)
+	}
+	if reason != "" {
+		p.setStage(STAGE_ERROR)
+		p.abortable = false
+		if perr != nil {
+			p.report(ERROR_POLICY, perr)
+			return "", perr
+		}
+		p.report(ERROR_REJECTED, errors.New(reason))
+		return "", errors.New("offer rejected: " + reason)
+	}
+	if string(p.magic[:]) == "UTP2" {
+		if _, err := p.conn.Write(p.zero8[:]); err != nil {
+			p.setStage(STAGE_ERROR)
+			return "", err
+		}
+	}
+
+	// 4. Receive & Decrypt Body
+	switch ops.BodyAlgo {
+	case "gcm1": // whole body in memory
+		if headSize+uint64(ops.Size) != totalSize {
+			p.setStage(STAGE_ERROR)
+			return "", errors.New("invalid body size")
+		}
+		encBody := make([]byte, totalSize-headSize)
+		if err := p.recv(encBody); err != nil {
+			p.setStage(STAGE_ERROR)
+			return "", err
 		}
-		if currentReceived == totalSize {
-			break
+		p.setStage(STAGE_ENCRYPTING)
+		aes := new(Bencrypt.AES1)
+		code := ERROR_DECRYPT
+		decBody, err := aes.DeAESGCM(key, encBody)
+		if err == nil {
+			_, err = w.Write(decBody)
+			code = errorCode(err)
 		}
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
+			p.report(code, err)
+			p.setStage(STAGE_ERROR)
+			return "", err
+		}
+
+	case "gcmx1": // framed chunks
+		c, err := newChunkCipher(key[:])
+		if err != nil {
+			p.setStage(STAGE_ERROR)
+			return "", err
+		}
+		chunks := (ops.Size + int64(CHUNK_SIZE) + 15) / int64(CHUNK_SIZE+16)
+		head := int64(5) // frame header, plus chunk flag with compression
+		var zip *chunkZip
+		if p.comp == COMP_DEFLATE {
+			head = 6
+			zip = newChunkZip("")
+		}
+		trailer := uint64(0)
+		if p.resumable() {
+			trailer = DIGEST_FRAME
+		}
+		if ops.Size < 16 || headSize+uint64(ops.Size)+uint64(head*chunks)+trailer != totalSize {
 			p.setStage(STAGE_ERROR)
-			return peerPub, myPub, nil, "", err
+			return "", errors.New("invalid body size")
+		}
+		if p.nstreams[1] > 1 {
+			defer p.closeStreams()
+			if err := p.acceptStreams(key[:]); err != nil {
+				p.setStage(STAGE_ERROR)
+				return "", err
+			}
+		}
+
+		// read next frames while decrypting and writing, chunk i is on stream i
+		frames, free, halt := pipeline(chunks, PIPE_DEPTH, CHUNK_SIZE+17, func(i int64, frame []byte) ([]byte, error) {
+			n := min(ops.Size-i*int64(CHUNK_SIZE+16), int64(CHUNK_SIZE+16))
+			conn := p.stream(i)
+			if err := p.recvFrom(conn, frame[:5]); err != nil {
+				return nil, err
+			}
+			if isErrorFrame(frame[0]) {
+				return nil, p.readError(conn, frame[0], Opsec.DecodeInt(frame[1:5]))
+			}
+			size := int64(Opsec.DecodeInt(frame[1:5]))
+			if zip != nil { // flag byte, compressed chunk is not larger than stored one
+				if size < 17 || size > n+1 {
+					size = -1
+				}
+			} else if size != n {
+				size = -1
+			}
+			if frame[0] != FRAME_DATA || size < 0 {
+				return nil, errors.New("invalid frame")
+			}
+			n = size
+			if err := p.recvFrom(conn, frame[:n]); err != nil {
+				return nil, err
+			}
+			return frame[:n], nil
+		})
+		stop := func() { // unblock reader before waiting for it
+			p.conn.SetReadDeadline(time.Now())
+			for _, c := range p.extraStreams() {
+				c.SetReadDeadline(time.Now())
+			}
+			halt()
+		}
+		for i := int64(0); i < chunks; i++ {
+			if p.ctx.Err() != nil {
+				stop()
+				p.setStage(STAGE_ERROR)
+				return "", p.ctx.Err()
+			}
+			f := <-frames
+			if fromPeer(f.err) {
+				p.abortable = false
+			}
+			if f.err != nil {
+				stop()
+				p.setStage(STAGE_ERROR)
+				return "", f.err
+			}
+			code := ERROR_DECRYPT
+			plain, err := c.open(f.data, uint64(i))
+			if err == nil && zip != nil {
+				n := min(ops.Size-i*int64(CHUNK_SIZE+16), int64(CHUNK_SIZE+16)) - 16
+				p.addSaved(int(head+n+16) - 5 - len(f.data))
+				plain, err = zip.unpack(plain, int(n))
+			}
+			if err == nil {
+				_, err = w.Write(plain)
+				code = errorCode(err)
+			}
+			if err != nil {
+				stop()
+				p.report(code, err)
+				p.setStage(STAGE_ERROR)
+				return "", err
+			}
+			free <- f.data
+		}
+		halt()
+		if p.resumable() {
+			if p.sum, err = p.receiveDigest(c, uint64(chunks)); err != nil {
+				p.setStage(STAGE_ERROR)
+				return "", err
+			}
 		}
+
+	default:
+		p.setStage(STAGE_ERROR)
+		return "", errors.New("unsupported body algorithm: " + ops.BodyAlgo)
 	}
 
-	// 4. Send Termination
+	// 5. Complete output, send Termination
+	if done != nil {
+		if err := done(); err != nil {
+			p.report(errorCode(err), err)
+			p.setStage(STAGE_ERROR)
+			return "", err
+		}
+	}
 	if _, err := p.conn.Write(p.zero8[:]); err != nil {
 		p.setStage(STAGE_ERROR)
-		return peerPub, myPub, nil, "", err
+		return "", err
 	}
+	p.setStage(STAGE_COMPLETE)
+	return ops.Smsg, nil
+}
 
-	// 5. Parse & Decrypt Header
-	bufReader := bytes.NewReader(payload)
-	ops := new(Opsec.Opsec)
-	headBytes, err := ops.Read(bufReader, 0)
+// encrypted message session of MODE_MSGONLY, Send and Receive may run at the same time
+type TPmessages struct {
+	p       *TPprotocol
+	end     func()
+	out     *chunkCipher // my messages
+	in      *chunkCipher // peer messages
+	outSeq  uint64
+	inSeq   uint64
+	lock    sync.Mutex // send lock
+	once    sync.Once
+	closed  bool
+	peerPub []byte
+	myPub   []byte
+	myPriv  []byte // body of pull session
+}
+
+// Open message session as sender
+func (p *TPprotocol) OpenMessages() (*TPmessages, error) {
+	return p.OpenMessagesContext(context.Background())
+}
+
+// OpenMessages, session is aborted when ctx is done
+func (p *TPprotocol) OpenMessagesContext(ctx context.Context) (*TPmessages, error) {
+	end := p.begin(ctx)
+	m, err := p.openMessages("msg1")
 	if err != nil {
-		p.setStage(STAGE_ERROR)
-		return peerPub, myPub, nil, "", err
+		err = p.cause(err)
+		end()
+		return nil, err
 	}
-	ops.View(headBytes)
-	if err := ops.Decpub(myPriv, peerPub); err != nil {
+	m.end = end
+	return m, nil
+}
+
+// algo is "msg1" for chat or "pull1" for MODE_PULL
+func (p *TPprotocol) openMessages(algo string) (*TPmessages, error) {
+	// 1. Handshake
+	p.setStage(STAGE_HANDSHAKE)
+	p.Mode |= MODE_MSGONLY
+	peerPub, myPub, myPriv, err := p.handshakeSend()
+	if err != nil {
 		p.setStage(STAGE_ERROR)
-		return peerPub, myPub, nil, "", err
+		return nil, err
 	}
 
-	// 6. Decrypt Body
+	// 2. Send session key in opsec header: Size(4) + Header
 	p.setStage(STAGE_ENCRYPTING)
-	bodyOffset := totalSize - uint64(bufReader.Len())
-	encBody := payload[bodyOffset:]
-	if ops.BodyAlgo != "gcm1" {
+	ops := new(Opsec.Opsec)
+	ops.Reset()
+	ops.Size = 0 // makes body key
+	ops.BodyAlgo = algo
+	opsHead, err := encpub(ops, p.headAlgo(), peerPub, myPriv)
+	if err != nil {
 		p.setStage(STAGE_ERROR)
-		return peerPub, myPub, nil, "", errors.New("unsupported body algorithm: " + ops.BodyAlgo)
+		return nil, err
 	}
-	var key [44]byte
-	copy(key[:], ops.BodyKey)
-	aes := new(Bencrypt.AES1)
-	decBody, err := aes.DeAESGCM(key, encBody)
-	if err != nil {
+	var headerBuf bytes.Buffer
+	if err := ops.Write(&headerBuf, opsHead); err != nil {
 		p.setStage(STAGE_ERROR)
-		return peerPub, myPub, nil, "", err
+		return nil, err
 	}
-
-	p.setStage(STAGE_COMPLETE)
-	return peerPub, myPub, decBody, ops.Smsg, nil
-}
-
-// AFT Vault
-type AVault struct {
-	Path  string
-	Limit int64
-	// name rule: *, */, */*
-
-	Algo    string // ecc1, rsa1
-	Ext     string // webp, png, bin
-	Public  []byte
-	Private []byte
-
-	TreeView map[string][]string // treeview with plain name
-	PtoCtbl  map[string]string   // plain name -> cipher name
-	CtoPtbl  map[string]string   // cipher name -> plain name
+	p.setStage(STAGE_TRANSFERRING)
+	if err := p.send(append(Opsec.EncodeInt(uint64(headerBuf.Len()), 4), headerBuf.Bytes()...)); err != nil {
+		p.setStage(STAGE_ERROR)
+		return nil, err
+	}
+	return newMessages(p, ops.BodyKey, true, peerPub, myPub, myPriv)
 }
 
-func (a *AVault) prehead() []byte {
-	var ico Icons.Icons
-	var v []byte
-	switch a.Ext {
-	case "webp":
-		v, _ = ico.Zip_webp()
-	case "png":
-		v, _ = ico.Zip_png()
-	default:
-		return nil
-	}
-	v = append(v, make([]byte, 128-len(v)%128)...)
-	return v
+// Accept message session as receiver
+func (p *TPprotocol) AcceptMessages() (*TPmessages, error) {
+	return p.AcceptMessagesContext(context.Background())
 }
 
-func (a *AVault) NewKeypair() error {
-	var err error
-	if a.Algo == "ecc1" {
-		a.Public, a.Private, err = new(Bencrypt.ECC1).Genkey()
-	} else if a.Algo == "rsa1" {
-		a.Public, a.Private, err = new(Bencrypt.RSA1).Genkey(4096)
-	} else {
-		return errors.New("unsupported algorithm")
+// AcceptMessages, session is aborted when ctx is done
+func (p *TPprotocol) AcceptMessagesContext(ctx context.Context) (*TPmessages, error) {
+	end := p.begin(ctx)
+	m, err := p.acceptMessages("msg1")
+	if err != nil {
+		err = p.cause(err)
+		end()
+		return nil, err
 	}
-	return err
+	m.end = end
+	return m, nil
 }
 
-// load vault from disk
-func (a *AVault) Load(pw string, kf []byte) (string, error) {
-	// 1. find account.*, name.* files
-	files, err := os.ReadDir(a.Path)
+func (p *TPprotocol) acceptMessages(algo string) (*TPmessages, error) {
+	// 1. Handshake
+	p.setStage(STAGE_HANDSHAKE)
+	peerPub, myPub, myPriv, err := p.handshakeReceive()
 	if err != nil {
-		return "", err
+		p.setStage(STAGE_ERROR)
+		return nil, err
 	}
-	found := 0
-	accPath := ""
-	nmPath := ""
-	for _, f := range files {
-		if !f.IsDir() && strings.HasPrefix(f.Name(), "account.") && !strings.HasSuffix(f.Name(), ".old") {
-			found++
-			accPath = filepath.Join(a.Path, f.Name())
+	if p.Mode&MODE_MSGONLY == 0 {
+		p.setStage(STAGE_ERROR)
+		return nil, errors.New("peer did not open message session")
+	}
+	if pull := p.Mode&MODE_PULL != 0; pull != (algo == "pull1") {
+		err := errors.New("peer opened pull session")
+		if !pull {
+			err = errors.New("peer did not open pull session")
 		}
-		if !f.IsDir() && strings.HasPrefix(f.Name(), "name.") && !strings.HasSuffix(f.Name(), ".old") {
-			found++
-			nmPath = filepath.Join(a.Path, f.Name())
+		p.report(ERROR_REJECTED, err)
+		p.setStage(STAGE_ERROR)
+		return nil, err
+	}
+
+	// 2. Receive session key: Size(4) + Header
+	p.setStage(STAGE_TRANSFERRING)
+	var buf4 [4]byte
+	if err := p.recv(buf4[:]); err != nil {
+		p.setStage(STAGE_ERROR)
+		return nil, err
+	}
+	if buf4 == [4]byte(p.max8[:4]) { // sender failed after handshake, max8 and error frame
+		p.setStage(STAGE_ERROR)
+		if err := p.recv(buf4[:]); err != nil {
+			return nil, err
 		}
+		return nil, p.readFailure(errors.New("remote error reported"))
 	}
-	if found != 2 {
-		return "", errors.New("cannot find data files")
+	size := Opsec.DecodeInt(buf4[:])
+	if size > 65536 {
+		p.setStage(STAGE_ERROR)
+		return nil, errors.New("invalid opsec header")
 	}
-
-	// 2. Read account file
-	accData, err := os.ReadFile(accPath)
-	if err != nil {
-		return "", err
+	headerBuf := make([]byte, size)
+	if err := p.recv(headerBuf); err != nil {
+		p.setStage(STAGE_ERROR)
+		return nil, err
 	}
-	var opsAcc Opsec.Opsec
-	opsAcc.Reset()
-	h, err := opsAcc.Read(bytes.NewReader(accData), 0)
-	if err != nil {
-		return "", err
+	ops := new(Opsec.Opsec)
+	headBytes, err := ops.Read(bytes.NewReader(headerBuf), 0)
+	if err != nil || headBytes == nil {
+		p.setStage(STAGE_ERROR)
+		return nil, errors.New("invalid opsec header")
+	}
+	if err := view(ops, headBytes); err != nil {
+		p.setStage(STAGE_ERROR)
+		return nil, err
+	}
+	if err := decpub(ops, p.headAlgo(), myPriv, peerPub); err != nil {
+		p.setStage(STAGE_ERROR)
+		return nil, err
 	}
-	opsAcc.View(h)
-	if err := opsAcc.Decpw([]byte(pw), kf); err != nil {
-		return opsAcc.Msg, err
+	if ops.BodyAlgo != algo {
+		p.setStage(STAGE_ERROR)
+		return nil, errors.New("unsupported body algorithm: " + ops.BodyAlgo)
 	}
+	return newMessages(p, ops.BodyKey, false, peerPub, myPub, myPriv)
+}
 
-	// Load Smsg (Algo, Ext, Public, Private)
-	parts := strings.Split(opsAcc.Smsg, "\n")
-	if len(parts) != 4 {
-		return opsAcc.Msg, errors.New("invalid account format")
+// derive key of each direction from session key
+func newMessages(p *TPprotocol, key []byte, opener bool, peerPub []byte, myPub []byte, myPriv []byte) (*TPmessages, error) {
+	if len(key) != 44 {
+		p.setStage(STAGE_ERROR)
+		return nil, errors.New("invalid body key")
 	}
-	a.Algo = parts[0]
-	a.Ext = parts[1]
-	b := new(Bencode.Bencode)
-	b.Init()
-	a.Public, err = b.Decode(parts[2])
+	openKey, err := Bencrypt.Genkey(key, "AFT_MSG_OPENER", 44)
 	if err != nil {
-		return opsAcc.Msg, err
+		p.setStage(STAGE_ERROR)
+		return nil, err
 	}
-	a.Private, err = b.Decode(parts[3])
+	acceptKey, err := Bencrypt.Genkey(key, "AFT_MSG_ACCEPTER", 44)
 	if err != nil {
-		return opsAcc.Msg, err
+		p.setStage(STAGE_ERROR)
+		return nil, err
 	}
-
-	// 3. Read name file
-	nameData, err := os.ReadFile(nmPath)
-	if err != nil {
-		return opsAcc.Msg, err
+	if !opener {
+		openKey, acceptKey = acceptKey, openKey
 	}
-	var opsName Opsec.Opsec
-	opsName.Reset()
-	rd := bytes.NewReader(nameData)
-	h, err = opsName.Read(rd, 0)
+	out, err := newChunkCipher(openKey)
 	if err != nil {
-		return opsAcc.Msg, err
+		p.setStage(STAGE_ERROR)
+		return nil, err
 	}
-	opsName.View(h)
-	if err := opsName.Decpub(a.Private, a.Public); err != nil {
-		return opsAcc.Msg, err
+	in, err := newChunkCipher(acceptKey)
+	if err != nil {
+		p.setStage(STAGE_ERROR)
+		return nil, err
 	}
+	return &TPmessages{p: p, out: out, in: in, peerPub: peerPub, myPub: myPub, myPriv: myPriv}, nil
+}
 
-	// 4. Decrypt body
-	var key [44]byte
-	copy(key[:], opsName.BodyKey)
-	aes := new(Bencrypt.AES1)
-	encBody := make([]byte, opsName.Size)
-	io.ReadFull(rd, encBody)
-	decBody, err := aes.DeAESGCM(key, encBody)
-	encBody = nil
+// public key is [peer, mine]
+func (m *TPmessages) Keys() ([]byte, []byte) {
+	return m.peerPub, m.myPub
+}
+
+// Send one message, sequence number is bound to nonce
+func (m *TPmessages) Send(text string) error {
+	if len(text) > MSG_MAX {
+		return errors.New("message is too long")
+	}
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return errors.New("message session is closed")
+	}
+	frame := make([]byte, 5, 5+len(text)+16)
+	frame = append(frame, text...)
+	enc := m.out.seal(frame[5:], m.outSeq)
+	frame[0] = FRAME_MSG
+	copy(frame[1:5], Opsec.EncodeInt(uint64(len(enc)), 4))
+	err := m.p.send(frame[:5+len(enc)])
+	m.outSeq++
+	m.lock.Unlock()
 	if err != nil {
-		return opsAcc.Msg, err
+		return m.fail(err)
 	}
+	return nil
+}
 
-	// 5. Parse NameTable (\n delimiter)
-	nameLines := strings.Split(string(decBody), "\n")
-	decBody = nil
-	a.PtoCtbl = make(map[string]string)
-	a.CtoPtbl = make(map[string]string)
-	for i := 0; i < len(nameLines)-1; i += 2 {
-		if i+1 < len(nameLines) {
-			a.PtoCtbl[nameLines[i]] = nameLines[i+1]
-			a.CtoPtbl[nameLines[i+1]] = nameLines[i]
-		}
+// Receive next message, io.EOF when peer closed session
+func (m *TPmessages) Receive() (string, error) {
+	var head [5]byte
+	if err := m.p.recv(head[:]); err != nil {
+		return "", m.fail(err)
+	}
+	size := Opsec.DecodeInt(head[1:5])
+	switch head[0] {
+	case FRAME_CLOSE:
+		return "", io.EOF
+	case FRAME_ABORT, FRAME_ERROR:
+		return "", m.fail(m.p.readError(m.p.conn, head[0], size))
+	case FRAME_MSG:
+	default:
+		return "", m.fail(errors.New("invalid frame"))
 	}
+	if size < 16 || size > uint64(MSG_MAX+16) {
+		return "", m.fail(errors.New("invalid frame"))
+	}
+	enc := make([]byte, size)
+	if err := m.p.recv(enc); err != nil {
+		return "", m.fail(err)
+	}
+	plain, err := m.in.open(enc, m.inSeq)
+	if err != nil {
+		return "", m.fail(err)
+	}
+	m.inSeq++
+	return string(plain), nil
+}
 
-	// 6. make name tree
-	a.TreeView = make(map[string][]string)
-	a.TreeView[""] = make([]string, 0)
-	for plain := range a.PtoCtbl {
-		idx := strings.IndexAny(plain, "/")
-		if idx == -1 { // golbal file
-			a.TreeView[""] = append(a.TreeView[""], plain)
-		} else { // folder or file in folder
-			parent, child := plain[:idx+1], plain[idx+1:]
-			if _, ok := a.TreeView[parent]; !ok { // add parent folder
-				a.TreeView[parent] = make([]string, 0)
-			}
-			if child == "" { // add parent folder to root
-				a.TreeView[""] = append(a.TreeView[""], parent)
-			} else { // add child file
-				a.TreeView[parent] = append(a.TreeView[parent], child)
-			}
+// map error to cause, tell peer when session is cancelled
+func (m *TPmessages) fail(err error) error {
+	m.lock.Lock()
+	closed := m.closed
+	if !closed && m.p.ctx.Err() != nil {
+		m.closed = true
+		cause := context.Cause(m.p.ctx)
+		if !fromPeer(cause) {
+			m.p.abort(cause, false)
 		}
 	}
-	for parent := range a.TreeView {
-		sort.Strings(a.TreeView[parent])
+	m.lock.Unlock()
+	if closed {
+		return errors.New("message session is closed")
 	}
-	a.Limit = 512 * 1024 * 1024
-	return opsAcc.Msg, nil
+	return m.p.cause(err)
 }
 
-// store name table to disk
-func (a *AVault) StoreName() error {
-	// make name list binary
-	nameList := make([]string, 2*len(a.PtoCtbl))
-	idx := 0
-	for plain, cipher := range a.PtoCtbl {
-		nameList[idx] = plain
-		nameList[idx+1] = cipher
-		idx += 2
-	}
-	data := []byte(strings.Join(nameList, "\n"))
-	nameList = nil
+// Close session, peer Receive returns io.EOF
+func (m *TPmessages) Close() error {
+	var err error
+	m.lock.Lock()
+	if !m.closed {
+		m.closed = true
+		err = m.p.send([]byte{FRAME_CLOSE, 0, 0, 0, 0})
+		m.p.setStage(STAGE_COMPLETE)
+	}
+	m.p.conn.SetReadDeadline(time.Now()) // stop pending Receive
+	m.lock.Unlock()
+	m.once.Do(m.end)
+	return err
+}
 
-	// make header
-	var ops Opsec.Opsec
-	ops.Reset()
-	ops.Size = int64(len(data)) + 16
-	header, err := ops.Encpub(a.Algo, a.Public, a.Private)
-	if err != nil {
-		return err
-	}
+// manifest entry of multi-file transfer
+type TPfile struct {
+	Name  string      // relative path, '/' separated, folder ends with '/'
+	Size  int64       // 0 for folder
+	Mode  os.FileMode // permission bits
+	Mtime time.Time
+}
 
-	// encrypt body
-	var key [44]byte
-	copy(key[:], ops.BodyKey)
-	aes := new(Bencrypt.AES1)
-	encBody, err := aes.EnAESGCM(key, data)
-	data = nil
+// Send file or folder with manifest (one file without it to UTP1), public key is [from, to]
+func (p *TPprotocol) SendFiles(path string, smsg string) ([]byte, []byte, error) {
+	return p.SendFilesContext(context.Background(), path, smsg)
+}
+
+// SendFiles aborted when ctx is done
+func (p *TPprotocol) SendFilesContext(ctx context.Context, path string, smsg string) ([]byte, []byte, error) {
+	// 1. Make manifest
+	files, err := listFiles(path)
 	if err != nil {
-		return err
+		p.setStage(STAGE_ERROR)
+		return nil, nil, p.failed(err)
 	}
-
-	// write to file
-	path := filepath.Join(a.Path, "name."+a.Ext)
-	os.Rename(path, path+".old")
-	file, err := os.Create(path)
+	manifest, err := encodeManifest(files)
 	if err != nil {
-		return err
+		p.setStage(STAGE_ERROR)
+		return nil, nil, p.failed(err)
 	}
-	defer file.Close()
-	prehead := a.prehead()
-	if prehead != nil {
-		file.Write(prehead)
+	size := int64(4 + len(manifest))
+	for _, f := range files {
+		size += f.Size
 	}
-	if err := ops.Write(file, header); err != nil {
-		return err
+	if p.OfferName == "" {
+		p.OfferName = filepath.Base(filepath.Clean(path))
 	}
-	file.Write(encBody)
-	return nil
+
+	// 2. UTP1 has no manifest, one file is sent as plain stream
+	if p.Version == 1 {
+		if len(files) != 1 || strings.HasSuffix(files[0].Name, "/") {
+			p.setStage(STAGE_ERROR)
+			return nil, nil, p.failed(errors.New("UTP1 peer can only receive one file"))
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			p.setStage(STAGE_ERROR)
+			return nil, nil, p.failed(err)
+		}
+		defer file.Close()
+		return p.SendStreamContext(ctx, file, files[0].Size, smsg)
+	}
+
+	// 3. Send ManifestSize(4) + Manifest + FileData...
+	p.Mode |= MODE_FILES
+	p.OfferType = "files"
+	head := append(Opsec.EncodeInt(uint64(len(manifest)), 4), manifest...)
+	r := io.MultiReader(bytes.NewReader(head), &filesReader{base: filepath.Dir(filepath.Clean(path)), files: files})
+	return p.SendStreamContext(ctx, r, size, smsg)
 }
 
-// store account to disk
-func (a *AVault) StoreAccount(pw string, kf []byte, msg string) error {
-	// make account text
-	b := new(Bencode.Bencode)
-	b.Init()
-	data := strings.Join([]string{a.Algo, a.Ext, b.Encode(a.Public, true), b.Encode(a.Private, true)}, "\n")
+// Receive files under folder, stream without manifest is saved by offer name, public key is [from, to]
+func (p *TPprotocol) ReceiveFiles(dir string) ([]byte, []byte, []TPfile, string, error) {
+	return p.ReceiveFilesContext(context.Background(), dir)
+}
 
-	// make header
-	var ops Opsec.Opsec
-	ops.Reset()
-	ops.Msg = msg
-	ops.Smsg = data
-	algo := "arg1"
-	if a.Algo == "rsa1" {
-		algo = "pbk1"
-	}
-	header, err := ops.Encpw(algo, []byte(pw), kf)
+// ReceiveFiles aborted when ctx is done, received files are kept
+func (p *TPprotocol) ReceiveFilesContext(ctx context.Context, dir string) ([]byte, []byte, []TPfile, string, error) {
+	end := p.begin(ctx)
+	defer end()
+	peerPub, myPub, files, smsg, err := p.receiveFiles(dir)
+	err = p.cause(err)
+	return peerPub, myPub, files, smsg, p.record("recv", p.offer.Name, peerPub, smsg, err)
+}
+
+func (p *TPprotocol) receiveFiles(dir string) ([]byte, []byte, []TPfile, string, error) {
+	// 1. Handshake
+	p.setStage(STAGE_HANDSHAKE)
+	peerPub, myPub, myPriv, err := p.handshakeReceive()
 	if err != nil {
-		return err
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, nil, "", err
 	}
 
-	// write to file
-	path := filepath.Join(a.Path, "account."+a.Ext)
-	os.Rename(path, path+".old")
-	file, err := os.Create(path)
+	// 2. Receive body to files, stream without manifest (UTP1, SendStream) is one file
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, nil, "", err
+	}
+	root, err := os.OpenRoot(dir)
 	if err != nil {
-		return err
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, nil, "", err
 	}
-	defer file.Close()
-	prehead := a.prehead()
-	if prehead != nil {
-		file.Write(prehead)
+	defer root.Close()
+	fw := &filesWriter{root: root}
+	if p.Mode&MODE_FILES == 0 {
+		fw.offer = &p.offer
 	}
-	return ops.Write(file, header)
-}
-
-// add file or folder to vault
-func (a *AVault) Add(path string, dirname string) error {
-	info, err := os.Stat(path)
+	smsg, err := p.receiveBody(fw, peerPub, myPriv, fw.finish)
 	if err != nil {
-		return err
+		fw.finish() // close file of failed transfer
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, fw.files, smsg, err
 	}
+	return peerPub, myPub, fw.files, smsg, nil
+}
 
-	// add file, assume dirname exists
-	if !info.IsDir() {
-		if info.Size() > a.Limit {
-			return errors.New("file size too big")
+// list file or folder recursively, names are relative to parent of path
+func listFiles(path string) ([]TPfile, error) {
+	path = filepath.Clean(path)
+	base := filepath.Dir(path)
+	res := make([]TPfile, 0)
+	err := filepath.Walk(path, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
 		}
-		data, err := os.ReadFile(path)
+		rel, err := filepath.Rel(base, fpath)
 		if err != nil {
 			return err
 		}
-		return a.Write(dirname+info.Name(), data)
-	}
+		f := TPfile{Name: filepath.ToSlash(rel), Mode: info.Mode().Perm(), Mtime: info.ModTime()}
+		if info.IsDir() {
+			f.Name += "/"
+		} else if info.Mode().IsRegular() {
+			f.Size = info.Size()
+		} else { // skip links, devices
+			return nil
+		}
+		res = append(res, f)
+		return nil
+	})
+	return res, err
+}
 
-	// add folder (single layer)
-	if _, ok := a.PtoCtbl[info.Name()+"/"]; ok {
-		return errors.New("folder already exists")
+// check manifest name is local relative path
+func validName(name string) bool {
+	name = strings.TrimSuffix(name, "/")
+	if name == "" || strings.ContainsAny(name, "\\:\x00") || path.Clean(name) != name {
+		return false
 	}
-	cParent := ""
-	for {
-		cParent = hex.EncodeToString(Bencrypt.Random(12)) + "/"
-		if _, collision := a.CtoPtbl[cParent]; !collision {
-			break
+	return filepath.IsLocal(filepath.FromSlash(name))
+}
+
+// Count(4) + [PathSize(2) + Path + Size(8) + Mode(4) + Mtime(8)]...
+func encodeManifest(files []TPfile) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(Opsec.EncodeInt(uint64(len(files)), 4))
+	for _, f := range files {
+		if len(f.Name) > 65535 {
+			return nil, errors.New("path is too long: " + f.Name)
 		}
+		buf.Write(Opsec.EncodeInt(uint64(len(f.Name)), 2))
+		buf.WriteString(f.Name)
+		buf.Write(Opsec.EncodeInt(uint64(f.Size), 8))
+		buf.Write(Opsec.EncodeInt(uint64(f.Mode.Perm()), 4))
+		buf.Write(Opsec.EncodeInt(uint64(f.Mtime.Unix()), 8))
 	}
-	os.Mkdir(filepath.Join(a.Path, cParent), 0755)
-	a.PtoCtbl[info.Name()+"/"] = cParent
-	a.CtoPtbl[cParent] = info.Name() + "/"
-	a.TreeView[info.Name()+"/"] = make([]string, 0)
-	a.TreeView[""] = append(a.TreeView[""], info.Name()+"/")
-	sort.Strings(a.TreeView[""])
+	return buf.Bytes(), nil
+}
 
-	files, err := os.ReadDir(path)
-	if err != nil {
-		return err
+func decodeManifest(data []byte) ([]TPfile, error) {
+	if len(data) < 4 {
+		return nil, errors.New("invalid manifest")
 	}
-	if len(files) == 0 {
-		return a.StoreName() // store empty folder
+	count := Opsec.DecodeInt(data[0:4])
+	if count > uint64(len(data)) {
+		return nil, errors.New("invalid manifest")
 	}
-	for _, file := range files {
-		if !file.IsDir() { // add only first layer
-			if err := a.Add(filepath.Join(path, file.Name()), info.Name()+"/"); err != nil {
-				return err
-			}
+	res := make([]TPfile, 0, count)
+	pos := 4
+	for i := uint64(0); i < count; i++ {
+		if pos+2 > len(data) {
+			return nil, errors.New("invalid manifest")
+		}
+		nameLen := int(Opsec.DecodeInt(data[pos : pos+2]))
+		pos += 2
+		if pos+nameLen+20 > len(data) {
+			return nil, errors.New("invalid manifest")
+		}
+		f := TPfile{Name: string(data[pos : pos+nameLen])}
+		pos += nameLen
+		f.Size = int64(Opsec.DecodeInt(data[pos : pos+8]))
+		f.Mode = os.FileMode(Opsec.DecodeInt(data[pos+8 : pos+12])).Perm()
+		f.Mtime = time.Unix(int64(Opsec.DecodeInt(data[pos+12:pos+20])), 0)
+		pos += 20
+		if !validName(f.Name) {
+			return nil, errors.New("invalid path in manifest: " + f.Name)
 		}
+		if f.Size < 0 || (strings.HasSuffix(f.Name, "/") && f.Size != 0) {
+			return nil, errors.New("invalid size in manifest: " + f.Name)
+		}
+		res = append(res, f)
 	}
-	return nil
+	if pos != len(data) {
+		return nil, errors.New("invalid manifest")
+	}
+	return res, nil
 }
 
-// delete file or folder from vault
-func (a *AVault) Del(name string) error {
-	isFolder := strings.HasSuffix(name, "/")
+// read manifest files in order, opens one file at a time
+type filesReader struct {
+	base  string
+	files []TPfile
+	idx   int
+	cur   *os.File
+	left  int64
+}
 
-	// delete actual files, update tables
-	for plain, cipher := range a.PtoCtbl {
-		if plain == name || (isFolder && strings.HasPrefix(plain, name)) {
-			os.RemoveAll(filepath.Join(a.Path, cipher))
-			delete(a.CtoPtbl, cipher)
-			delete(a.PtoCtbl, plain)
+func (r *filesReader) Read(data []byte) (int, error) {
+	for r.cur == nil {
+		if r.idx >= len(r.files) {
+			return 0, io.EOF
+		}
+		f := r.files[r.idx]
+		r.idx++
+		if strings.HasSuffix(f.Name, "/") || f.Size == 0 {
+			continue
+		}
+		file, err := os.Open(filepath.Join(r.base, filepath.FromSlash(f.Name)))
+		if err != nil {
+			return 0, err
 		}
+		r.cur, r.left = file, f.Size
 	}
+	n, err := r.cur.Read(data[:min(int64(len(data)), r.left)])
+	r.left -= int64(n)
+	if r.left == 0 {
+		r.cur.Close()
+		r.cur = nil
+		return n, nil
+	}
+	if err == io.EOF {
+		r.cur.Close()
+		r.cur = nil
+		return n, errors.New("file changed while sending")
+	}
+	return n, err
+}
 
-	// update treeview
-	if isFolder {
-		list := a.TreeView[""]
-		for i, v := range list {
-			if v == name {
-				a.TreeView[""] = append(list[:i], list[i+1:]...)
-				break
+// write manifest stream to files, root blocks escaping links
+type filesWriter struct {
+	root  *os.Root
+	files []TPfile
+	head  []byte // ManifestSize(4) + Manifest
+	idx   int
+	cur   *os.File
+	left  int64
+	offer *TPoffer // stream without manifest is one file named by offer
+}
+
+func (w *filesWriter) Write(data []byte) (int, error) {
+	total := len(data)
+	if err := w.plain(); err != nil {
+		return 0, err
+	}
+	for len(data) > 0 {
+		// 1. collect manifest
+		if w.files == nil {
+			need := 4
+			if len(w.head) >= 4 {
+				size := Opsec.DecodeInt(w.head[0:4])
+				if size < 4 || size > 64*1024*1024 {
+					return 0, errors.New("invalid manifest size")
+				}
+				need += int(size)
 			}
+			n := min(need-len(w.head), len(data))
+			w.head = append(w.head, data[:n]...)
+			data = data[n:]
+			if len(w.head) == need && need > 4 {
+				files, err := decodeManifest(w.head[4:])
+				if err != nil {
+					return 0, err
+				}
+				w.files, w.head = files, nil
+				if err := w.next(); err != nil {
+					return 0, err
+				}
+			}
+			continue
 		}
-		delete(a.TreeView, name)
 
-	} else {
-		parent, child := "", name
-		if idx := strings.Index(name, "/"); idx != -1 {
-			parent, child = name[:idx+1], name[idx+1:]
-		}
-		list := a.TreeView[parent]
-		for i, v := range list {
-			if v == child {
-				a.TreeView[parent] = append(list[:i], list[i+1:]...)
-				break
+		// 2. write current file
+		if w.cur == nil {
+			return 0, errors.New("data exceeds manifest")
+		}
+		n, err := w.cur.Write(data[:min(int64(len(data)), w.left)])
+		w.left -= int64(n)
+		data = data[n:]
+		if err != nil {
+			return 0, err
+		}
+		if w.left == 0 {
+			if err := w.next(); err != nil {
+				return 0, err
 			}
 		}
 	}
-	return a.StoreName()
+	return total, nil
 }
 
-// rename file or folder in vault
-func (a *AVault) Rename(src string, dst string) error {
-	// check source
-	if _, ok := a.PtoCtbl[src]; !ok {
-		return errors.New("source not found")
-	}
-	if _, ok := a.PtoCtbl[dst]; ok {
-		return errors.New("destination already exists")
-	}
-	isFolder := strings.HasSuffix(src, "/")
-	if isFolder && !strings.HasSuffix(dst, "/") {
-		return errors.New("invalid destination for folder")
+// make manifest of single file from offer once it is known
+func (w *filesWriter) plain() error {
+	if w.offer == nil || w.files != nil {
+		return nil
 	}
-	idx0 := strings.Index(src, "/")
-	idx1 := strings.Index(dst, "/")
-	if !isFolder {
-		dir0 := ""
-		if idx0 != -1 {
-			dir0 = src[:idx0+1]
-		}
-		dir1 := ""
-		if idx1 != -1 {
-			dir1 = dst[:idx1+1]
-		}
-		if dir0 != dir1 {
-			return errors.New("invalid destination for file")
-		}
+	name := w.offer.Name
+	if !validName(name) || strings.Contains(name, "/") {
+		return errors.New("invalid file name: " + name)
 	}
+	w.files = []TPfile{{Name: name, Size: w.offer.Size, Mode: 0644, Mtime: time.Now()}}
+	return w.next()
+}
 
-	// rename tables
-	for pName, cName := range a.PtoCtbl {
-		if pName == src || (isFolder && strings.HasPrefix(pName, src)) {
-			updatedPName := dst + pName[len(src):]
-			delete(a.PtoCtbl, pName)
-			delete(a.CtoPtbl, cName)
-			a.PtoCtbl[updatedPName] = cName
-			a.CtoPtbl[cName] = updatedPName
+// close current file, make folders and open next non-empty file
+func (w *filesWriter) next() error {
+	if w.cur != nil {
+		err := w.cur.Close()
+		w.cur = nil
+		if err != nil {
+			return err
 		}
-	}
-
-	// update treeview
-	if isFolder {
-		idx := slices.Index(a.TreeView[""], src)
-		if idx != -1 {
-			a.TreeView[""][idx] = dst
-			sort.Strings(a.TreeView[""])
+		f := w.files[w.idx-1]
+		w.root.Chtimes(filepath.FromSlash(f.Name), f.Mtime, f.Mtime)
+	}
+	for w.idx < len(w.files) {
+		f := w.files[w.idx]
+		w.idx++
+		fpath := filepath.FromSlash(strings.TrimSuffix(f.Name, "/"))
+		if strings.HasSuffix(f.Name, "/") {
+			if err := w.root.MkdirAll(fpath, 0755); err != nil {
+				return err
+			}
+			continue
 		}
-		a.TreeView[dst] = a.TreeView[src]
-		delete(a.TreeView, src)
-
-	} else {
-		parent, oldChild := "", src
-		if idx0 != -1 {
-			parent, oldChild = src[:idx0+1], src[idx0+1:]
+		if dir := filepath.Dir(fpath); dir != "." {
+			if err := w.root.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
 		}
-		newChild := dst
-		if idx1 != -1 {
-			newChild = dst[idx1+1:]
+		file, err := w.root.OpenFile(fpath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, f.Mode|0600)
+		if err != nil {
+			return err
 		}
-		idx := slices.Index(a.TreeView[parent], oldChild)
-		if idx != -1 {
-			a.TreeView[parent][idx] = newChild
-			sort.Strings(a.TreeView[parent])
+		if f.Size > 0 {
+			w.cur, w.left = file, f.Size
+			return nil
 		}
+		file.Close()
+		w.root.Chtimes(fpath, f.Mtime, f.Mtime)
 	}
-	return a.StoreName()
+	return nil
 }
 
-// read file from vault
-func (a *AVault) Read(name string) ([]byte, error) {
-	// find cipher name, read file
-	cipher, ok := a.PtoCtbl[name]
-	if !ok {
-		return nil, errors.New("file not found in vault")
+// close open file, set folder times, check all files are complete
+func (w *filesWriter) finish() error {
+	if err := w.plain(); err != nil {
+		return err
 	}
-	data, err := os.ReadFile(filepath.Join(a.Path, cipher))
-	if err != nil {
-		return nil, err
+	if w.cur != nil {
+		w.cur.Close()
+		w.cur = nil
+		return errors.New("incomplete file: " + w.files[w.idx-1].Name)
 	}
-
-	// read header
-	var ops Opsec.Opsec
-	ops.Reset()
-	rd := bytes.NewReader(data)
-	h, err := ops.Read(rd, 0)
-	if err != nil {
-		return nil, err
+	if w.files == nil || w.idx < len(w.files) {
+		return errors.New("incomplete manifest transfer")
 	}
-	ops.View(h)
-	if err := ops.Decpub(a.Private, a.Public); err != nil {
-		return nil, err
+	for i := len(w.files) - 1; i >= 0; i-- {
+		if f := w.files[i]; strings.HasSuffix(f.Name, "/") {
+			w.root.Chtimes(filepath.FromSlash(strings.TrimSuffix(f.Name, "/")), f.Mtime, f.Mtime)
+		}
 	}
-
-	// decrypt body
-	var key [44]byte
-	copy(key[:], ops.BodyKey)
-	aes := new(Bencrypt.AES1)
-	body := make([]byte, ops.Size)
-	io.ReadFull(rd, body)
-	return aes.DeAESGCM(key, body)
+	return nil
 }
 
-// write file to vault, make new if not exists
-func (a *AVault) Write(name string, data []byte) error {
-	// check size
-	if int64(len(data)) > a.Limit {
-		return errors.New("file size too big")
+// short fingerprint of public key
+func Fingerprint(public []byte) string {
+	h := hex.EncodeToString(Bencrypt.Sha3256(public)[:16])
+	parts := make([]string, 0, 8)
+	for i := 0; i < len(h); i += 4 {
+		parts = append(parts, h[i:i+4])
 	}
+	return strings.Join(parts, ":")
+}
 
-	// check exists
-	cipher, exists := a.PtoCtbl[name]
-	if !exists {
-		// split name
-		parent, child := "", name
-		if idx := strings.Index(name, "/"); idx != -1 {
-			parent = name[:idx+1]
-			child = name[idx+1:]
-		}
-
-		// make new cipher name, update tables
-		for {
-			cChild := hex.EncodeToString(Bencrypt.Random(12)) + "." + a.Ext
-			if parent == "" {
-				cipher = cChild
-			} else {
-				cipher = a.PtoCtbl[parent] + cChild
-			}
-			if _, collision := a.CtoPtbl[cipher]; !collision {
-				break
-			}
-		}
-		a.PtoCtbl[name] = cipher
-		a.CtoPtbl[cipher] = name
+// long-term identity key of this device
+type TPidentity struct {
+	Path    string
+	Name    string
+	Public  []byte // ecc1
+	Private []byte
+}
 
-		// update treeview
-		if _, ok := a.TreeView[parent]; !ok {
-			a.TreeView[parent] = make([]string, 0)
-		}
-		a.TreeView[parent] = append(a.TreeView[parent], child)
-		sort.Strings(a.TreeView[parent])
-	}
+func (i *TPidentity) NewKeypair() error {
+	var err error
+	i.Public, i.Private, err = new(Bencrypt.ECC1).Genkey()
+	return err
+}
 
-	// make header
-	var ops Opsec.Opsec
-	ops.Reset()
-	ops.Size = int64(len(data)) + 16
-	ops.BodyAlgo = "gcm1"
-	header, err := ops.Encpub(a.Algo, a.Public, a.Private)
+// load identity file (Name, Public, Private)
+func (i *TPidentity) Load() error {
+	data, err := os.ReadFile(i.Path)
 	if err != nil {
 		return err
 	}
+	parts := strings.Split(string(data), "\n")
+	if len(parts) != 3 {
+		return errors.New("invalid identity format")
+	}
+	b := new(Bencode.Bencode)
+	b.Init()
+	i.Name = parts[0]
+	if i.Public, err = b.Decode(parts[1]); err != nil {
+		return err
+	}
+	i.Private, err = b.Decode(parts[2])
+	return err
+}
 
-	// encrypt body
-	var key [44]byte
-	copy(key[:], ops.BodyKey)
-	aes := new(Bencrypt.AES1)
-	encBody, err := aes.EnAESGCM(key, data)
-	data = nil
-	if err != nil {
+// store identity file, readable only by owner
+func (i *TPidentity) Store() error {
+	if strings.ContainsAny(i.Name, "\n") {
+		return errors.New("invalid identity name")
+	}
+	b := new(Bencode.Bencode)
+	b.Init()
+	data := strings.Join([]string{i.Name, b.Encode(i.Public, true), b.Encode(i.Private, true)}, "\n")
+	if err := os.MkdirAll(filepath.Dir(i.Path), 0700); err != nil {
 		return err
 	}
+	return os.WriteFile(i.Path, []byte(data), 0600)
+}
 
-	// write file
-	f, err := os.Create(filepath.Join(a.Path, cipher))
-	if err != nil {
+// trusted peers file, peer name -> identity public key
+type TPpeers struct {
+	Path  string
+	Peers map[string][]byte
+	lock  sync.Mutex
+}
+
+// load peers file (Name, Public)..., missing file is empty
+func (t *TPpeers) Load() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.Peers = make(map[string][]byte)
+	data, err := os.ReadFile(t.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
 		return err
 	}
-	defer f.Close()
-	if pre := a.prehead(); pre != nil {
-		f.Write(pre)
+	b := new(Bencode.Bencode)
+	b.Init()
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i+1 < len(lines); i += 2 {
+		pub, err := b.Decode(lines[i+1])
+		if err != nil {
+			return err
+		}
+		t.Peers[lines[i]] = pub
+	}
+	return nil
+}
+
+func (t *TPpeers) Store() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	names := make([]string, 0, len(t.Peers))
+	for name := range t.Peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b := new(Bencode.Bencode)
+	b.Init()
+	lines := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		lines = append(lines, name, b.Encode(t.Peers[name], true))
 	}
-	if err := ops.Write(f, header); err != nil {
+	if err := os.MkdirAll(filepath.Dir(t.Path), 0700); err != nil {
 		return err
 	}
-	f.Write(encBody)
-	return a.StoreName()
+	return os.WriteFile(t.Path, []byte(strings.Join(lines, "\n")), 0600)
 }
 
-// sync vault with file system
-func (a *AVault) Trim() (int, error) {
-	count := 0
+// returns PEER_NEW, PEER_TRUSTED, PEER_CHANGED
+func (t *TPpeers) Check(name string, public []byte) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	known, ok := t.Peers[name]
+	if !ok {
+		return PEER_NEW
+	} else if bytes.Equal(known, public) {
+		return PEER_TRUSTED
+	}
+	return PEER_CHANGED
+}
 
-	// delete registered but not exists
-	for plain, cipher := range a.PtoCtbl {
-		fPath := filepath.Join(a.Path, cipher)
-		if _, err := os.Stat(fPath); os.IsNotExist(err) {
-			delete(a.PtoCtbl, plain)
-			delete(a.CtoPtbl, cipher)
-			count++
-		}
+func (t *TPpeers) Add(name string, public []byte) error {
+	if name == "" || strings.ContainsAny(name, "\n") {
+		return errors.New("invalid peer name")
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.Peers == nil {
+		t.Peers = make(map[string][]byte)
 	}
+	t.Peers[name] = public
+	return nil
+}
 
-	// delete unregistered but exists
-	err := filepath.Walk(a.Path, func(path string, info os.FileInfo, err error) error {
-		if err != nil || path == a.Path {
-			return nil
-		}
-		rel, _ := filepath.Rel(a.Path, path)
-		rel = filepath.ToSlash(rel)
+func (t *TPpeers) Del(name string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.Peers[name]; !ok {
+		return errors.New("peer not found")
+	}
+	delete(t.Peers, name)
+	return nil
+}
 
-		// skip account and name files
-		if strings.HasPrefix(rel, "account.") || strings.HasPrefix(rel, "name.") {
-			return nil
-		}
+// receiver side store of resumable sessions
+type TPresume struct {
+	Dir    string        // partial file folder
+	Expire time.Duration // session lifetime, 0 for 24h
+}
 
-		// make lookup key
-		key := rel
-		if info.IsDir() {
-			key += "/"
-		}
+// file of session: .part data, .peer identity key of sender, .done finished data
+func (s *TPresume) path(id []byte, ext string) string {
+	return filepath.Join(s.Dir, hex.EncodeToString(id)+ext)
+}
 
-		// delete if not exists in table
-		if _, ok := a.CtoPtbl[key]; !ok {
-			os.RemoveAll(path)
-			count++
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-		}
+// returns acked offset of session, 0 if not found
+func (s *TPresume) offset(id []byte) uint64 {
+	s.Clean()
+	info, err := os.Stat(s.path(id, ".part"))
+	if err != nil {
+		return 0
+	}
+	return uint64(info.Size())
+}
+
+// bind session to identity key of sender, fails if another peer started it
+func (s *TPresume) claim(id []byte, peer []byte) error {
+	owner, err := os.ReadFile(s.path(id, ".peer"))
+	if err == nil && !bytes.Equal(owner, peer) {
+		return errors.New("resume session belongs to another peer")
+	} else if err == nil {
 		return nil
-	})
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.WriteFile(s.path(id, ".peer"), peer, 0644)
+}
+
+// compare whole partial file with hash from sender
+func (s *TPresume) check(id []byte, sum []byte) error {
+	f, err := os.Open(s.path(id, ".part"))
 	if err != nil {
-		return count, err
+		return err
+	}
+	defer f.Close()
+	h := sha3.New256()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
 	}
+	if !hmac.Equal(h.Sum(nil), sum) {
+		return errors.New("resumed file does not match sender")
+	}
+	return nil
+}
 
-	// rebuild treeview
-	a.TreeView = make(map[string][]string)
-	a.TreeView[""] = make([]string, 0)
-	for plain := range a.PtoCtbl {
-		idx := strings.Index(plain, "/")
-		if idx == -1 { // global files
-			a.TreeView[""] = append(a.TreeView[""], plain)
-		} else { // folders and files in folders
-			parent, child := plain[:idx+1], plain[idx+1:]
-			if _, ok := a.TreeView[parent]; !ok { // add parent folder
-				a.TreeView[parent] = make([]string, 0)
-			}
-			if child == "" { // add parent folder to root
-				a.TreeView[""] = append(a.TreeView[""], parent)
-			} else { // add child file
-				a.TreeView[parent] = append(a.TreeView[parent], child)
+// drop partial file and owner of session
+func (s *TPresume) remove(id []byte) {
+	os.Remove(s.path(id, ".part"))
+	os.Remove(s.path(id, ".peer"))
+}
+
+// remove expired partial files, returns removed count
+func (s *TPresume) Clean() (int, error) {
+	expire := s.Expire
+	if expire <= 0 {
+		expire = 24 * time.Hour
+	}
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".part") {
+			continue
+		}
+		info, err := f.Info()
+		if err == nil && time.Since(info.ModTime()) > expire {
+			if os.Remove(filepath.Join(s.Dir, f.Name())) == nil {
+				os.Remove(filepath.Join(s.Dir, strings.TrimSuffix(f.Name(), ".part")+".peer"))
+				count++
 			}
 		}
 	}
-
-	// sort and save
-	for k := range a.TreeView {
-		sort.Strings(a.TreeView[k])
-	}
-	return count, a.StoreName()
+	return count, nil
 }
@@ -0,0 +1,1279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k-atusa/USAG-Lib/Bencrypt"
+	"github.com/k-atusa/USAG-Lib/Opsec"
+)
+
+// connected loopback TCP pair
+func pair(t testing.TB) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ch := make(chan net.Conn)
+	go func() { c, _ := ln.Accept(); ch <- c }()
+	c1, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-ch
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	return c1, c2
+}
+
+// fresh identity trusting any peer
+func identity(t testing.TB, p *TPprotocol, name string) {
+	p.Identity = &TPidentity{Name: name}
+	if err := p.Identity.NewKeypair(); err != nil {
+		t.Fatal(err)
+	}
+	p.Trust = func(string, string, int) bool { return true }
+}
+
+// reader failing after cut bytes
+type failReader struct {
+	r   *bytes.Reader
+	cut int64
+}
+
+func (f *failReader) Read(b []byte) (int, error) {
+	pos := f.r.Size() - int64(f.r.Len())
+	if pos >= f.cut {
+		return 0, net.ErrClosed
+	}
+	if int64(len(b)) > f.cut-pos {
+		b = b[:f.cut-pos]
+	}
+	return f.r.Read(b)
+}
+
+// send data from r in a resumable session, returns receiver result
+func resumeOnce(t *testing.T, s *TPprotocol, r *TPprotocol, store *TPresume, src *failReader) (string, error) {
+	a, b := pair(t)
+	id := s.TransferID
+	s.Init(MODE_RESUME, a)
+	s.TransferID = id
+	r.Init(0, b)
+	done := make(chan bool)
+	go func() {
+		s.SendStream(src, src.r.Size(), "m")
+		a.Close()
+		close(done)
+	}()
+	_, _, path, _, err := r.ReceiveResume(store)
+	b.Close()
+	<-done
+	return path, err
+}
+
+func TestResume(t *testing.T) {
+	data := make([]byte, CHUNK_SIZE*3+100)
+	rand.Read(data)
+	cut := int64(CHUNK_SIZE*2 + 5)
+	var s, r, other TPprotocol
+	identity(t, &s, "s")
+	identity(t, &r, "r")
+	identity(t, &other, "o")
+
+	// 1. Interrupted session keeps partial file, same sender continues at acked chunk
+	store := &TPresume{Dir: t.TempDir()}
+	if _, err := resumeOnce(t, &s, &r, store, &failReader{bytes.NewReader(data), cut}); err == nil {
+		t.Fatal("interrupted transfer succeeded")
+	}
+	path, err := resumeOnce(t, &s, &r, store, &failReader{bytes.NewReader(data), int64(len(data))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.offset != uint64(CHUNK_SIZE*2) {
+		t.Fatal("offset", s.offset)
+	}
+	if got, _ := os.ReadFile(path); !bytes.Equal(got, data) {
+		t.Fatal("resumed file differs")
+	}
+
+	// 2. Another identity with the same transfer ID is rejected, partial file is kept
+	store = &TPresume{Dir: t.TempDir()}
+	s.TransferID = nil
+	resumeOnce(t, &s, &r, store, &failReader{bytes.NewReader(data), cut})
+	other.TransferID = s.TransferID
+	_, err = resumeOnce(t, &other, &r, store, &failReader{bytes.NewReader(data), int64(len(data))})
+	if err == nil || !strings.Contains(err.Error(), "another peer") {
+		t.Fatal("resumed session of another peer", err)
+	}
+	if info, err := os.Stat(store.path(s.TransferID, ".part")); err != nil || info.Size() != int64(CHUNK_SIZE*2) {
+		t.Fatal("partial file changed", err)
+	}
+
+	// 3. Changed source fails whole file hash, partial file is dropped
+	changed := bytes.Clone(data)
+	changed[0] ^= 1
+	_, err = resumeOnce(t, &s, &r, store, &failReader{bytes.NewReader(changed), int64(len(data))})
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatal("resumed changed file", err)
+	}
+	if _, err := os.Stat(store.path(s.TransferID, ".part")); !os.IsNotExist(err) {
+		t.Fatal("partial file kept after hash mismatch")
+	}
+
+	// 4. Session without identity starts over
+	var anon TPprotocol
+	store = &TPresume{Dir: t.TempDir()}
+	resumeOnce(t, &s, &r, store, &failReader{bytes.NewReader(data), cut})
+	anon.TransferID = s.TransferID
+	r.Identity = nil
+	if _, err := resumeOnce(t, &anon, &r, store, &failReader{bytes.NewReader(data), int64(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if anon.offset != 0 {
+		t.Fatal("resumed without identity", anon.offset)
+	}
+}
+
+func TestSAS(t *testing.T) {
+	// 1. Both users see the same code, either side can reject
+	for _, acc := range []bool{true, false} {
+		a, b := pair(t)
+		var s, r TPprotocol
+		s.Init(0, a)
+		r.Init(0, b)
+		var sw, rw string
+		s.Confirm = func(w, d string) bool { sw = w + d; return true }
+		r.Confirm = func(w, d string) bool { rw = w + d; return acc }
+		errc := make(chan error, 1)
+		go func() { _, _, err := s.SendData([]byte("abc"), ""); errc <- err }()
+		_, _, got, _, err := r.ReceiveData()
+		serr := <-errc
+		if acc && (err != nil || serr != nil || string(got) != "abc" || sw != rw) {
+			t.Fatal(err, serr)
+		}
+		if !acc && (err == nil || serr == nil) {
+			t.Fatal("rejected SAS was accepted")
+		}
+	}
+
+	// 2. Receiver asking for SAS rejects sender that skipped it
+	a, b := pair(t)
+	var s, r TPprotocol
+	s.Init(0, a)
+	r.Init(0, b)
+	r.Confirm = func(string, string) bool { return true }
+	go s.SendData([]byte("abc"), "")
+	if _, _, _, _, err := r.ReceiveData(); err == nil || !strings.Contains(err.Error(), "SAS") {
+		t.Fatal("accepted sender without SAS", err)
+	}
+
+	// 3. Revealed key must match commitment in hello
+	a, b = pair(t)
+	r.Init(0, b)
+	go func() {
+		committed, _, _ := new(Bencrypt.ECC1).Genkey()
+		revealed, _, _ := new(Bencrypt.ECC1).Genkey()
+		hello := append([]byte("UTP2"), Opsec.EncodeInt(uint64(MODE_VERIFY), 2)...)
+		hello = append(hello, Opsec.EncodeInt(uint64(r.features()), 2)...)
+		hello = append(hello, Opsec.EncodeInt(uint64(CIPHER_GCMX1), 2)...)
+		hello = append(hello, Opsec.EncodeInt(uint64(COMP_NONE), 2)...)
+		hello = append(hello, Opsec.EncodeInt(32, 2)...)
+		a.Write(append(hello, sasCommit(committed)...))
+		a.Write(append(Opsec.EncodeInt(uint64(len(revealed)), 2), revealed...))
+		io.Copy(io.Discard, a)
+	}()
+	if _, _, _, _, err := r.ReceiveData(); err == nil || !strings.Contains(err.Error(), "commitment") {
+		t.Fatal("accepted key not matching commitment", err)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	send := func(s *TPprotocol, r *TPprotocol) error {
+		a, b := pair(t)
+		s.Init(0, a)
+		r.Init(0, b)
+		done := make(chan bool)
+		go func() { s.SendData([]byte("abc"), ""); close(done) }()
+		_, _, _, _, err := r.ReceiveData()
+		b.Close()
+		<-done
+		return err
+	}
+	var s, r TPprotocol
+	identity(t, &r, "r")
+	r.Peers = &TPpeers{Path: t.TempDir() + "/peers", Peers: map[string][]byte{}}
+
+	// 1. Receiver with identity rejects anonymous sender
+	if err := send(&s, &r); err == nil || !strings.Contains(err.Error(), "identity") {
+		t.Fatal("accepted sender without identity", err)
+	}
+
+	// 2. New peer needs Trust, then is known without it
+	identity(t, &s, "s")
+	r.Trust = nil
+	if err := send(&s, &r); err == nil || len(r.Peers.Peers) != 0 {
+		t.Fatal("trusted new peer without Trust", err)
+	}
+	r.Trust = func(string, string, int) bool { return true }
+	if err := send(&s, &r); err != nil || len(r.Peers.Peers) != 1 {
+		t.Fatal("new peer not trusted", err)
+	}
+	r.Trust = nil
+	if err := send(&s, &r); err != nil {
+		t.Fatal("known peer rejected", err)
+	}
+
+	// 3. Known name with another key is rejected
+	s.Identity.NewKeypair()
+	if err := send(&s, &r); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Fatal("accepted changed identity", err)
+	}
+}
+
+func TestAuthError(t *testing.T) {
+	// returns (sender error, receiver error) of transfer or message session
+	run := func(setup func(s, r *TPprotocol), msg bool) (error, error) {
+		a, b := pair(t)
+		var s, r TPprotocol
+		s.Init(0, a)
+		r.Init(0, b)
+		setup(&s, &r)
+		errc := make(chan error, 1)
+		go func() {
+			var err error
+			if msg {
+				var m *TPmessages
+				if m, err = s.OpenMessages(); err == nil {
+					m.Close()
+				}
+			} else {
+				_, _, err = s.SendData([]byte("abc"), "")
+			}
+			a.Close()
+			errc <- err
+		}()
+		var err error
+		if msg {
+			var m *TPmessages
+			if m, err = r.AcceptMessages(); err == nil {
+				m.Close()
+			}
+		} else {
+			_, _, _, _, err = r.ReceiveData()
+		}
+		b.Close()
+		return <-errc, err
+	}
+	distrust := func(p *TPprotocol) { p.Trust = func(string, string, int) bool { return false } }
+	refuse := func(string, string) bool { return false }
+	accept := func(string, string) bool { return true }
+
+	// 1. Side that refuses authentication sends coded frame, reason needs session keys
+	for i, c := range []struct {
+		setup       func(s, r *TPprotocol)
+		msg, byRecv bool
+	}{
+		{func(s, r *TPprotocol) { identity(t, s, "s"); identity(t, r, "r"); distrust(r) }, false, true},
+		{func(s, r *TPprotocol) { identity(t, s, "s"); identity(t, r, "r"); distrust(s) }, false, false},
+		{func(s, r *TPprotocol) { identity(t, s, "s"); identity(t, r, "r"); distrust(s) }, true, false},
+		{func(s, r *TPprotocol) { s.Confirm, r.Confirm = accept, refuse }, false, true},
+		{func(s, r *TPprotocol) { s.Confirm, r.Confirm = refuse, accept }, false, false},
+	} {
+		serr, rerr := run(c.setup, c.msg)
+		local, remote := serr, rerr
+		if c.byRecv {
+			local, remote = rerr, serr
+		}
+		var re *RejectError
+		if local == nil || !errors.As(remote, &re) {
+			t.Fatal(i, "refusal not reported to peer:", local, remote)
+		}
+	}
+}
+
+func TestPairCode(t *testing.T) {
+	// 1. Wrong code fails on both sides, so publisher knows to make new code
+	a, b := pair(t)
+	var c, srv TPprotocol
+	c.Init(0, a)
+	srv.Init(0, b)
+	c.Code, srv.Code = "7-crossbow-tulip", "8-crossbow-tulip"
+	errc := make(chan error, 1)
+	go func() { _, err := c.OpenPull(); errc <- err }()
+	err := srv.ServePull(&TPshared{})
+	if cerr := <-errc; !errors.Is(err, ErrPairCode) || !errors.Is(cerr, ErrPairCode) {
+		t.Fatal("wrong pairing code not reported", err, cerr)
+	}
+
+	// 2. Served pull session has idle limit by default
+	if srv.IdleTimeout != PULL_IDLE_TIMEOUT {
+		t.Fatal("pull session without idle timeout", srv.IdleTimeout)
+	}
+}
+
+func TestPull(t *testing.T) {
+	v := testVault(t)
+	big := make([]byte, 2*CHUNK_SIZE+7)
+	rand.Read(big)
+	if err := v.Write("big.bin", big); err != nil {
+		t.Fatal(err)
+	}
+	a, b := pair(t)
+	var c, srv TPprotocol
+	c.Init(0, a)
+	srv.Init(0, b)
+	c.Code, srv.Code = "7-crossbow-tulip", "7-crossbow-tulip"
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ServePull(&TPshared{Vault: v, Export: map[string][]string{"": {"*"}}}) }()
+	pull, err := c.OpenPull()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1. Files are streamed as body, session stays usable after each
+	if names, err := pull.List(""); err != nil || len(names) != 1 || names[0] != "big.bin" {
+		t.Fatal("list", names, err)
+	}
+	for range 2 {
+		var buf bytes.Buffer
+		if n, err := pull.Get("big.bin", &buf); err != nil || n != int64(len(big)) || !bytes.Equal(buf.Bytes(), big) {
+			t.Fatal("get", n, err)
+		}
+	}
+	if _, err := pull.Get("none.bin", io.Discard); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("missing file", err)
+	}
+
+	// 2. Close ends serving loop
+	pull.Close()
+	if err := <-errc; err != nil {
+		t.Fatal("serve", err)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	// 1. Free UDP port on loopback
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := udp.LocalAddr().String()
+	udp.Close()
+
+	// 2. Announce to the port while discovering on it
+	res := make(chan []TPbeacon, 1)
+	go func() {
+		found, err := Discover(addr, 1500*time.Millisecond)
+		if err != nil {
+			t.Error(err)
+		}
+		res <- found
+	}()
+	stop := make(chan bool)
+	go Announce("alice", 8123, []string{addr}, stop)
+	found := <-res
+	close(stop)
+	if len(found) != 1 || found[0].Name != "alice" || found[0].Port != 8123 || found[0].Addr != "127.0.0.1:8123" {
+		t.Fatal("beacon not found", found)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	run := func(setup func(s, r *TPprotocol)) (error, error) {
+		a, b := pair(t)
+		var s, r TPprotocol
+		s.Init(0, a)
+		r.Init(0, b)
+		setup(&s, &r)
+		data := make([]byte, CHUNK_SIZE+5)
+		rand.Read(data)
+		errc := make(chan error, 1)
+		go func() { _, _, err := s.SendData(data, "m"); a.Close(); errc <- err }()
+		_, _, got, _, err := r.ReceiveData()
+		b.Close()
+		if err == nil && !bytes.Equal(got, data) {
+			t.Fatal("received data differs")
+		}
+		return <-errc, err
+	}
+
+	// 1. UTP1 sender works with default receiver, not with one asking for identity or gcmx1 only
+	if se, re := run(func(s, r *TPprotocol) { s.Version = 1 }); se != nil || re != nil {
+		t.Fatal("UTP1 refused by default", se, re)
+	}
+	if se, re := run(func(s, r *TPprotocol) { s.Ciphers = CIPHER_GCM1 }); se != nil || re != nil {
+		t.Fatal("gcm1 refused by default", se, re)
+	}
+	if se, re := run(func(s, r *TPprotocol) { s.Version = 1; identity(t, r, "r") }); se == nil || re == nil || !strings.Contains(re.Error(), "identity") {
+		t.Fatal("UTP1 accepted by receiver with identity", se, re)
+	}
+	if se, re := run(func(s, r *TPprotocol) { s.Version = 1; r.Ciphers = CIPHER_GCMX1 }); se == nil || re == nil {
+		t.Fatal("UTP1 accepted without gcm1", se, re)
+	}
+
+	// 2. Required mode flags on both sides
+	if se, re := run(func(s, r *TPprotocol) { r.Require = MODE_PQ }); se == nil || re == nil || !strings.Contains(re.Error(), "required") {
+		t.Fatal("receiver requirement ignored", se, re)
+	}
+	if se, re := run(func(s, r *TPprotocol) { s.Mode = MODE_PQ; r.Require = MODE_PQ }); se != nil || re != nil {
+		t.Fatal("required flag set", se, re)
+	}
+	if se, _ := run(func(s, r *TPprotocol) { s.Require = MODE_PAKE }); se == nil {
+		t.Fatal("sender requirement ignored")
+	}
+
+	// 3. Unknown and contradictory flags
+	if se, re := run(func(s, r *TPprotocol) { s.Mode = MODE_RESUME; r.Features = MODE_ALL &^ MODE_RESUME }); se == nil || re == nil {
+		t.Fatal("unsupported flag accepted", se, re)
+	}
+	if se, _ := run(func(s, r *TPprotocol) { s.Mode = MODE_MSGONLY | MODE_FILES }); se == nil {
+		t.Fatal("contradictory flags accepted")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	src := t.TempDir()
+	os.WriteFile(src+"/a.txt", []byte("hello"), 0644)
+	run := func(setup func(s *TPprotocol), path string) ([]TPfile, error, error) {
+		a, b := pair(t)
+		var s, r TPprotocol
+		s.Init(0, a)
+		r.Init(0, b)
+		setup(&s)
+		errc := make(chan error, 1)
+		go func() { _, _, err := s.SendFiles(path, ""); a.Close(); errc <- err }()
+		_, _, files, _, err := r.ReceiveFiles(t.TempDir() + "/out")
+		b.Close()
+		return files, <-errc, err
+	}
+
+	// 1. UTP1 sends one file without manifest, saved by offer name
+	files, se, re := run(func(s *TPprotocol) { s.Version = 1 }, src+"/a.txt")
+	if se != nil || re != nil || len(files) != 1 || files[0].Name != "a.txt" || files[0].Size != 5 {
+		t.Fatal("UTP1 file not received", files, se, re)
+	}
+	if _, se, _ := run(func(s *TPprotocol) { s.Version = 1 }, src); se == nil {
+		t.Fatal("folder sent to UTP1 peer")
+	}
+
+	// 2. Chunked stream without manifest is one file of plain size
+	a, b := pair(t)
+	var s, r TPprotocol
+	s.Init(0, a)
+	r.Init(0, b)
+	s.OfferName = "c.bin"
+	data := make([]byte, 2*CHUNK_SIZE+7)
+	errc := make(chan error, 1)
+	go func() { _, _, err := s.SendData(data, ""); a.Close(); errc <- err }()
+	_, _, files, _, err := r.ReceiveFiles(t.TempDir())
+	if se := <-errc; se != nil || err != nil || len(files) != 1 || files[0].Size != int64(len(data)) {
+		t.Fatal("stream not received as file", files, se, err)
+	}
+
+	// 3. Offer name of stream without manifest must be plain file name, sender is told
+	a, b = pair(t)
+	s, r = TPprotocol{}, TPprotocol{}
+	s.Init(0, a)
+	r.Init(0, b)
+	s.OfferName = "../x"
+	go func() { _, _, err := s.SendData([]byte("abc"), ""); a.Close(); errc <- err }()
+	_, _, _, _, err = r.ReceiveFiles(t.TempDir())
+	if se := <-errc; err == nil || se == nil || !strings.Contains(se.Error(), "invalid file name") {
+		t.Fatal("unsafe offer name accepted", se, err)
+	}
+}
+
+// empty unlocked vault
+func testVault(t *testing.T) *AVault {
+	v := &AVault{Path: t.TempDir(), Limit: 1 << 24, Algo: "ecc1", Ext: "bin"}
+	v.TreeView = map[string][]string{"": {}}
+	v.PtoCtbl, v.CtoPtbl = map[string]string{}, map[string]string{}
+	if err := v.NewKeypair(); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestReceiveVault(t *testing.T) {
+	v := testVault(t)
+	src := t.TempDir()
+	os.WriteFile(src+"/a.txt", []byte("hello"), 0644)
+	os.WriteFile(src+"/b.txt", []byte("world"), 0644)
+	run := func(path string) (string, error, error) {
+		a, b := pair(t)
+		var s, r TPprotocol
+		s.Init(0, a)
+		r.Init(0, b)
+		errc := make(chan error, 1)
+		go func() { _, _, err := s.SendFiles(path, ""); a.Close(); errc <- err }()
+		_, _, name, _, err := r.ReceiveVault(v, "")
+		b.Close()
+		return name, <-errc, err
+	}
+
+	// 1. One file is stored by offer name
+	name, se, re := run(src + "/a.txt")
+	if se != nil || re != nil || name != "a.txt" {
+		t.Fatal("file not received into vault", name, se, re)
+	}
+	if data, err := v.Read("a.txt"); err != nil || string(data) != "hello" {
+		t.Fatal("vault file differs", err)
+	}
+
+	// 2. Failure to store is told to sender, not reported as success
+	if _, se, re := run(src); se == nil || re == nil || !strings.Contains(se.Error(), "only one file") {
+		t.Fatal("folder accepted into vault", se, re)
+	}
+	if _, se, re := run(src + "/a.txt"); se == nil || re == nil || !strings.Contains(se.Error(), "exists") {
+		t.Fatal("existing vault file overwritten", se, re)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	// 1. Records survive reload
+	dir := t.TempDir()
+	h := &TPhistory{Path: dir + "/history", PW: "pw"}
+	for _, name := range []string{"a", "b"} {
+		if err := h.Append(TPrecord{Time: time.Now(), Dir: "send", Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recs, err := h.Load()
+	if err != nil || len(recs) != 2 || recs[1].Name != "b" {
+		t.Fatal("records lost", recs, err)
+	}
+
+	// 2. Failed write keeps old file and leaves no temp file
+	old, _ := os.ReadFile(h.Path)
+	err = writeAtomic(h.Path, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return os.ErrClosed
+	})
+	if got, _ := os.ReadFile(h.Path); err == nil || !bytes.Equal(got, old) {
+		t.Fatal("history changed by failed write", err)
+	}
+	if ents, _ := os.ReadDir(dir); len(ents) != 1 {
+		t.Fatal("temp file left", ents)
+	}
+
+	// 3. Append adds one frame, frame cut by crash is dropped
+	os.WriteFile(h.Path, append(old, 0, 0, 1, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9), 0600)
+	if err := h.Append(TPrecord{Time: time.Now(), Dir: "recv", Name: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(h.Path)
+	recs, err = (&TPhistory{Path: h.Path, PW: "pw"}).Load()
+	if !bytes.HasPrefix(got, old) || err != nil || len(recs) != 3 || recs[2].Name != "c" {
+		t.Fatal("append rewrote history", len(recs), err)
+	}
+	if _, err := (&TPhistory{Path: h.Path, PW: "no"}).Load(); err == nil {
+		t.Fatal("history opened with wrong password")
+	}
+
+	// 4. Old history of one gcm1 body is read and converted on append
+	data := encodeRecords(recs)
+	var ops Opsec.Opsec
+	ops.Reset()
+	ops.Size = int64(len(data)) + 16
+	ops.BodyAlgo = "gcm1"
+	header, _ := ops.Encpw("arg1", []byte("pw"), nil)
+	var key [44]byte
+	copy(key[:], ops.BodyKey)
+	enc, _ := new(Bencrypt.AES1).EnAESGCM(key, data)
+	var buf bytes.Buffer
+	ops.Write(&buf, header)
+	buf.Write(enc)
+	os.WriteFile(h.Path, buf.Bytes(), 0600)
+	h = &TPhistory{Path: h.Path, PW: "pw"}
+	if recs, err := h.Load(); err != nil || len(recs) != 3 {
+		t.Fatal("old history not read", err)
+	}
+	if err := h.Append(TPrecord{Time: time.Now(), Dir: "send", Name: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if recs, err := (&TPhistory{Path: h.Path, PW: "pw"}).Load(); err != nil || len(recs) != 4 || recs[3].Name != "d" {
+		t.Fatal("old history not converted", err)
+	}
+}
+
+// listener failing with temporary errors before accepting
+type flakyListener struct {
+	net.Listener
+	fails int
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.fails > 0 {
+		l.fails--
+		return nil, tempError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := &TPserver{Inbox: t.TempDir(), MaxConns: 1}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ctx, &flakyListener{Listener: ln, fails: 3}) }()
+
+	// 1. Temporary accept errors don't stop server, silent conn holds the only session
+	busy, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	for len(srv.Sessions()) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 2. One refusal waits for hello, next one is closed at once
+	held, _ := net.Dial("tcp", ln.Addr().String())
+	defer held.Close()
+	time.Sleep(100 * time.Millisecond)
+	extra, _ := net.Dial("tcp", ln.Addr().String())
+	defer extra.Close()
+	start := time.Now()
+	extra.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := extra.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("extra refusal not closed", err)
+	}
+	held.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := held.Read(make([]byte, 1)); err != io.EOF || time.Since(start) > 3*time.Second {
+		t.Fatal("held refusal not closed in time", err)
+	}
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loopback transfer of 64 MiB
+func BenchmarkSendStream(b *testing.B) {
+	data := make([]byte, 64*CHUNK_SIZE)
+	rand.Read(data)
+	for _, c := range []struct {
+		name   string
+		cipher uint16
+	}{{"gcmx1", CIPHER_GCMX1}, {"gcm1", CIPHER_GCM1}} {
+		b.Run(c.name, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for b.Loop() {
+				a, r := pair(b)
+				var sp, rp TPprotocol
+				sp.Init(0, a)
+				rp.Init(0, r)
+				sp.Ciphers, rp.Ciphers = c.cipher, c.cipher
+				errc := make(chan error, 1)
+				go func() {
+					_, _, err := sp.SendStream(bytes.NewReader(data), int64(len(data)), "")
+					errc <- err
+				}()
+				if _, _, _, err := rp.ReceiveStream(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+				if err := <-errc; err != nil {
+					b.Fatal(err)
+				}
+				a.Close()
+				r.Close()
+			}
+		})
+	}
+}
+
+func TestMulti(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	data := make([]byte, 5*CHUNK_SIZE+123)
+	rand.Read(data)
+	a, b := pair(t)
+	var s, r TPprotocol
+	s.Init(0, a)
+	r.Init(0, b)
+	s.Streams, r.Streams = 4, 3
+	s.StreamDial = func() (net.Conn, error) { return net.Dial("tcp", ln.Addr().String()) }
+	r.StreamAccept = ln.Accept
+
+	// 1. Silent connection does not delay hellos of real streams
+	silent, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() { _, _, err := s.SendData(data, "m"); errc <- err }()
+	_, _, got, _, err := r.ReceiveData()
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatal("multi stream transfer failed", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if s.Mode&MODE_MULTI == 0 || s.nstreams[1] != 3 || time.Since(start) > 5*time.Second {
+		t.Fatal("streams", s.nstreams, time.Since(start))
+	}
+	if _, sent, total := r.GetStatus(); sent != total {
+		t.Fatal("status", sent, total)
+	}
+}
+
+// SOCKS5 stand-in on loopback, asks for user and pw if user is set, returns address
+func socksProxy(t *testing.T, user, pw string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	serve := func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, 262)
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			return
+		}
+		methods := buf[2 : 2+int(buf[1])]
+		if _, err := io.ReadFull(c, methods); err != nil {
+			return
+		}
+		if method := byte(0); user == "" || bytes.IndexByte(methods, 2) < 0 {
+			if user != "" {
+				method = 0xff
+			}
+			if c.Write([]byte{5, method}); method != 0 {
+				return
+			}
+		} else {
+			c.Write([]byte{5, 2})
+			field := func() string {
+				io.ReadFull(c, buf[:1])
+				io.ReadFull(c, buf[1:1+int(buf[0])])
+				return string(buf[1 : 1+int(buf[0])])
+			}
+			io.ReadFull(c, buf[:1])
+			if field() != user || field() != pw {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		}
+		if _, err := io.ReadFull(c, buf[:4]); err != nil {
+			return
+		}
+		var host string
+		switch buf[3] {
+		case 1, 4:
+			ip := make(net.IP, map[byte]int{1: 4, 4: 16}[buf[3]])
+			io.ReadFull(c, ip)
+			host = ip.String()
+		case 3:
+			io.ReadFull(c, buf[:1])
+			io.ReadFull(c, buf[1:1+int(buf[0])])
+			host = string(buf[1 : 1+int(buf[0])])
+		}
+		io.ReadFull(c, buf[:2])
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1]))))
+		if err != nil {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}) // connection refused
+			return
+		}
+		defer target.Close()
+		c.Write([]byte{5, 0, 0, 3, 4, 'p', 'e', 'e', 'r', 0, 0})
+		go io.Copy(target, c)
+		io.Copy(c, target)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echo server on listener, closed with test
+func echo(t *testing.T, ln net.Listener) string {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// round trip through conn to echo server
+func ping(conn net.Conn, err error) error {
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != "ping" {
+		return errors.New("echo mismatch: " + string(buf))
+	}
+	return nil
+}
+
+func TestTransport(t *testing.T) {
+	// 1. SOCKS5 CONNECT with and without auth, by IP and by name
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := echo(t, ln)
+	_, port, _ := net.SplitHostPort(target)
+	open, auth := socksProxy(t, "", ""), socksProxy(t, "alice", "s3cret")
+	if err := ping(Dial("socks5://" + open + "/" + target)); err != nil {
+		t.Fatal("no auth:", err)
+	}
+	if err := ping(Dial("socks5h://alice:s3cret@" + auth + "/localhost:" + port)); err != nil {
+		t.Fatal("user and password:", err)
+	}
+	if err := ping(Dial("socks5://alice:wrong@" + auth + "/" + target)); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatal("bad password accepted", err)
+	}
+	if err := ping(Dial("socks5://" + auth + "/" + target)); err == nil || !strings.Contains(err.Error(), "auth method") {
+		t.Fatal("proxy needing auth accepted anonymous client", err)
+	}
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	refused := closed.Addr().String()
+	closed.Close()
+	if err := ping(Dial("socks5://" + open + "/" + refused)); err == nil || !strings.Contains(err.Error(), "code 5") {
+		t.Fatal("refused target connected", err)
+	}
+
+	// 2. Unix socket
+	path := "unix://" + t.TempDir() + "/aft.sock"
+	uln, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, uln)
+	if err := ping(Dial(path)); err != nil {
+		t.Fatal("unix:", err)
+	}
+
+	// 3. Transfer over pipe pair, deadline unblocks read
+	pipes := func() (*pipeConn, *pipeConn) {
+		r1, w1, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r2, w2, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, b := &pipeConn{r: r1, w: w2, name: "a"}, &pipeConn{r: r2, w: w1, name: "b"}
+		t.Cleanup(func() { a.Close(); b.Close() })
+		return a, b
+	}
+	a, b := pipes()
+	var s, r TPprotocol
+	s.Init(0, a)
+	r.Init(0, b)
+	data := make([]byte, CHUNK_SIZE+5)
+	rand.Read(data)
+	errc := make(chan error, 1)
+	go func() { _, _, err := s.SendData(data, "m"); errc <- err }()
+	if _, _, got, _, err := r.ReceiveData(); err != nil || !bytes.Equal(got, data) {
+		t.Fatal("pipe transfer:", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := a.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("pipe read deadline not applied", err)
+	}
+}
+
+// conn recording bytes read from peer
+type recordConn struct {
+	net.Conn
+	rec *bytes.Buffer
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.rec.Write(b[:n])
+	return n, err
+}
+
+// bytes a receiver reads from sender in session set up by setup
+func capture(t testing.TB, setup func(s, r *TPprotocol), run func(s, r *TPprotocol)) []byte {
+	a, b := pair(t)
+	var rec bytes.Buffer
+	var s, r TPprotocol
+	s.Init(0, a)
+	r.Init(0, &recordConn{b, &rec})
+	setup(&s, &r)
+	run(&s, &r)
+	return rec.Bytes()
+}
+
+// feed in to receive over net.Pipe, peer reads all replies
+func feed(in []byte, receive func(conn net.Conn)) {
+	a, b := net.Pipe()
+	go io.Copy(io.Discard, a)
+	go func() {
+		a.Write(in)
+		a.Close()
+	}()
+	receive(b)
+	b.Close()
+}
+
+// read text and mask back from QR matrix by ISO 18004 layout, checking format and error correction
+func qrDecode(t *testing.T, m [][]bool) (string, int) {
+	size := len(m)
+	ver := (size - 17) / 4
+	at := func(x, y int) int {
+		if m[y][x] {
+			return 1
+		}
+		return 0
+	}
+
+	// 1. Format bits, both copies, MSB first
+	var f1, f2 int
+	for _, c := range [][2]int{{0, 8}, {1, 8}, {2, 8}, {3, 8}, {4, 8}, {5, 8}, {7, 8}, {8, 8}, {8, 7}, {8, 5}, {8, 4}, {8, 3}, {8, 2}, {8, 1}, {8, 0}} {
+		f1 = f1<<1 | at(c[0], c[1])
+	}
+	for i := range 15 {
+		if i < 7 {
+			f2 = f2<<1 | at(8, size-1-i)
+		} else {
+			f2 = f2<<1 | at(size-15+i, 8)
+		}
+	}
+	mask := -1
+	for i := range 8 {
+		if f1 == qrFormatBits(i) {
+			mask = i
+		}
+	}
+	if mask < 0 || f1 != f2 || at(8, size-8) != 1 {
+		t.Fatalf("bad format bits %x %x", f1, f2)
+	}
+	if ver >= 7 {
+		v1, v2 := 0, 0
+		for i := 17; i >= 0; i-- {
+			v1 = v1<<1 | at(i/3, size-11+i%3)
+			v2 = v2<<1 | at(size-11+i%3, i/3)
+		}
+		if v1 != qrVersionBits(ver) || v2 != v1 {
+			t.Fatalf("bad version bits %x %x", v1, v2)
+		}
+	}
+
+	// 2. Codewords upward and downward in column pairs, skipping function patterns
+	function := func(x, y int) bool {
+		if x < 9 && y < 9 || x >= size-8 && y < 9 || x < 9 && y >= size-8 || x == 6 || y == 6 {
+			return true
+		}
+		if ver >= 7 && (x < 6 && y >= size-11 && y < size-8 || y < 6 && x >= size-11 && x < size-8) {
+			return true
+		}
+		align := [][]int{2: {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50}}[ver]
+		for _, ax := range align {
+			for _, ay := range align {
+				if !(ax == 6 && ay == 6 || ax == 6 && ay == size-7 || ax == size-7 && ay == 6) && qrAbs(x-ax) <= 2 && qrAbs(y-ay) <= 2 {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	flip := []func(x, y int) bool{
+		func(x, y int) bool { return (x+y)%2 == 0 },
+		func(x, y int) bool { return y%2 == 0 },
+		func(x, y int) bool { return x%3 == 0 },
+		func(x, y int) bool { return (x+y)%3 == 0 },
+		func(x, y int) bool { return (y/2+x/3)%2 == 0 },
+		func(x, y int) bool { return x*y%2+x*y%3 == 0 },
+		func(x, y int) bool { return (x*y%2+x*y%3)%2 == 0 },
+		func(x, y int) bool { return ((x+y)%2+x*y%3)%2 == 0 },
+	}[mask]
+	var words []byte
+	n := 0
+	for col, up := size-1, true; col > 0; col, up = col-2, !up {
+		if col == 6 {
+			col--
+		}
+		for k := range size {
+			y := k
+			if up {
+				y = size - 1 - k
+			}
+			for _, x := range []int{col, col - 1} {
+				if function(x, y) {
+					continue
+				}
+				if n%8 == 0 {
+					words = append(words, 0)
+				}
+				if m[y][x] != flip(x, y) {
+					words[n/8] |= 0x80 >> (n % 8)
+				}
+				n++
+			}
+		}
+	}
+
+	// 3. Deinterleave, every block is codeword of RS code with roots 2^0..2^(ec-1)
+	b := qrBlocks[ver]
+	nb := b.n1 + b.n2
+	blocks := make([][]byte, nb)
+	pos := 0
+	for i := 0; i < max(b.d1, b.d2); i++ {
+		for j := range nb {
+			if i < b.d1 || j >= b.n1 {
+				blocks[j] = append(blocks[j], words[pos])
+				pos++
+			}
+		}
+	}
+	var data []byte
+	for _, blk := range blocks {
+		data = append(data, blk...)
+	}
+	for i := 0; i < b.ec; i++ {
+		for j := range nb {
+			blocks[j] = append(blocks[j], words[pos])
+			pos++
+		}
+	}
+	for j, blk := range blocks {
+		root := byte(1)
+		for range b.ec {
+			var v byte
+			for _, c := range blk {
+				v = qrMul(v, root) ^ c
+			}
+			if v != 0 {
+				t.Fatalf("block %d has nonzero syndrome", j)
+			}
+			root = qrMul(root, 2)
+		}
+	}
+
+	// 4. Byte mode segment
+	bit := func(i int) int { return int(data[i/8]>>(7-i%8)) & 1 }
+	read := func(pos, n int) int {
+		v := 0
+		for i := range n {
+			v = v<<1 | bit(pos+i)
+		}
+		return v
+	}
+	count := 8
+	if ver >= 10 {
+		count = 16
+	}
+	if read(0, 4) != 4 {
+		t.Fatal("not byte mode")
+	}
+	text := make([]byte, read(4, count))
+	for i := range text {
+		text[i] = byte(read(4+count+8*i, 8))
+	}
+	return string(text), mask
+}
+
+func TestQREncode(t *testing.T) {
+	// 1. Format and version words of ISO 18004 tables
+	format := []int{0x5412, 0x5125, 0x5E7C, 0x5B4B, 0x45F9, 0x40CE, 0x4F97, 0x4AA0}
+	for mask, want := range format {
+		if got := qrFormatBits(mask); got != want {
+			t.Fatalf("format M%d: %x, want %x", mask, got, want)
+		}
+	}
+	for ver, want := range map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3} {
+		if got := qrVersionBits(ver); got != want {
+			t.Fatalf("version %d: %x, want %x", ver, got, want)
+		}
+	}
+
+	// 2. Error correction of "HELLO WORLD" in 1-M
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := qrRemainder(data, qrGenerator(10)); !bytes.Equal(got, want) {
+		t.Fatal("rs codewords", got)
+	}
+
+	// 3. Whole matrix reads back for single and multi block versions
+	for _, tc := range []struct{ n, ver int }{{2, 1}, {20, 2}, {110, 7}, {140, 8}, {200, 10}} {
+		text := strings.Repeat("aft://x", tc.n)[:tc.n]
+		m, err := QREncode(text)
+		if err != nil || len(m) != 4*tc.ver+17 {
+			t.Fatal("qr version of", tc.n, len(m), err)
+		}
+		if got, _ := qrDecode(t, m); got != text {
+			t.Fatalf("qr of %d bytes reads %q", tc.n, got)
+		}
+	}
+
+	// 4. Every mask reads back
+	m, _ := QREncode("aft://mask")
+	_, cur := qrDecode(t, m)
+	q := newQRMatrix(1)
+	q.dark = m
+	for mask := range 8 {
+		q.mask(cur) // undo
+		q.mask(mask)
+		q.format(mask)
+		if got, at := qrDecode(t, q.dark); got != "aft://mask" || at != mask {
+			t.Fatal("mask", mask, "reads", got)
+		}
+		cur = mask
+	}
+	if _, err := QREncode(strings.Repeat("x", 214)); err == nil {
+		t.Fatal("too long text encoded")
+	}
+}
+
+func FuzzHandshake(f *testing.F) {
+	for _, setup := range []func(s, r *TPprotocol){
+		func(s, r *TPprotocol) {},
+		func(s, r *TPprotocol) { s.Mode, s.TransferID = MODE_RESUME, nil },
+		func(s, r *TPprotocol) { s.Version = 1 },
+		func(s, r *TPprotocol) { s.Confirm = func(string, string) bool { return true } },
+		func(s, r *TPprotocol) { s.Code, r.Code = "7-crossbow-tulip", "7-crossbow-tulip" },
+	} {
+		f.Add(capture(f, setup, func(s, r *TPprotocol) {
+			go s.SendData([]byte("seed"), "m")
+			r.Confirm = s.Confirm
+			r.ReceiveData()
+		}))
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		if len(in) >= 6 && uint16(Opsec.DecodeInt(in[4:6]))&MODE_LEGACY != 0 {
+			return // rsa keygen takes seconds per input
+		}
+		feed(in, func(conn net.Conn) {
+			var r TPprotocol
+			r.Init(0, conn)
+			r.Policy.HandshakeTimeout = 50 * time.Millisecond
+			r.IdleTimeout = 50 * time.Millisecond
+			r.ReceiveData()
+		})
+	})
+}
+
+func FuzzReceiveBody(f *testing.F) {
+	sPub, sPriv, _ := new(Bencrypt.ECC1).Genkey()
+	rPub, rPriv, _ := new(Bencrypt.ECC1).Genkey()
+	body := func(p *TPprotocol, cipher uint16) {
+		p.cipher, p.comp, p.nstreams = cipher, COMP_NONE, [2]int{1, 1}
+	}
+	for _, c := range []uint16{CIPHER_GCMX1, CIPHER_GCM1} {
+		f.Add(c, capture(f, func(s, r *TPprotocol) { body(s, c); body(r, c) }, func(s, r *TPprotocol) {
+			go s.sendBody(bytes.NewReader([]byte("seed")), 4, "m", rPub, sPriv)
+			r.receiveBody(io.Discard, sPub, rPriv, nil)
+		}))
+	}
+	f.Fuzz(func(t *testing.T, cipher uint16, in []byte) {
+		feed(in, func(conn net.Conn) {
+			var r TPprotocol
+			r.Init(0, conn)
+			body(&r, CIPHER_GCMX1)
+			if cipher == CIPHER_GCM1 {
+				r.cipher = CIPHER_GCM1
+			}
+			r.receiveBody(io.Discard, sPub, rPriv, nil)
+		})
+	})
+}
+
+func FuzzReadError(f *testing.F) {
+	sPub, sPriv, _ := new(Bencrypt.ECC1).Genkey()
+	rPub, rPriv, _ := new(Bencrypt.ECC1).Genkey()
+	var s TPprotocol
+	s.Init(0, nil)
+	s.peerKey, s.myKey = rPub, sPriv
+	f.Add(s.errorFrame(ERROR_DISK, "disk full"))
+	s.peerKey = nil
+	f.Add(s.errorFrame(ERROR_CANCELLED, "cancelled"))
+	f.Add(append([]byte{FRAME_ABORT, 4, 0, 0, 0}, "stop"...))
+	f.Fuzz(func(t *testing.T, in []byte) {
+		if len(in) < 5 {
+			return
+		}
+		var r TPprotocol
+		r.Init(0, nil)
+		r.peerKey, r.myKey = sPub, rPriv
+		if err := r.readError(bytes.NewReader(in[5:]), in[0], Opsec.DecodeInt(in[1:5])); err == nil {
+			t.Fatal("error frame read as success")
+		}
+	})
+}
+
+func FuzzManifest(f *testing.F) {
+	seed, _ := encodeManifest([]TPfile{{Name: "top/", Mode: 0755}, {Name: "top/a.txt", Size: 5, Mode: 0644, Mtime: time.Unix(1, 0)}})
+	f.Add(seed)
+	f.Fuzz(func(t *testing.T, in []byte) {
+		files, err := decodeManifest(in)
+		for _, file := range files {
+			if err == nil && (!validName(strings.TrimSuffix(file.Name, "/")) || file.Size < 0) {
+				t.Fatal("invalid entry accepted", file)
+			}
+		}
+	})
+}
+
+func FuzzRecords(f *testing.F) {
+	f.Add(encodeRecords([]TPrecord{{Time: time.Unix(1, 0), Dir: "send", Name: "a", Size: 5, Result: "ok"}}))
+	f.Fuzz(func(t *testing.T, in []byte) {
+		decodeRecords(in)
+	})
+}
+
+func FuzzHybrid(f *testing.F) {
+	pub, _, _ := genHybrid()
+	f.Add(pub)
+	f.Fuzz(func(t *testing.T, in []byte) {
+		ecc, kem, err := splitHybrid(in)
+		if err == nil && 2+len(ecc)+len(kem) != len(in) {
+			t.Fatal("split lost bytes")
+		}
+		var ops Opsec.Opsec
+		ops.Reset()
+		encpub(&ops, "pqc1", in, nil)
+	})
+}
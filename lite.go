@@ -2,14 +2,26 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/k-atusa/USAG-Lib/Bencode"
+	"github.com/k-atusa/USAG-Lib/Bencrypt"
 	"github.com/k-atusa/USAG-Lib/Opsec"
 )
 
@@ -21,16 +33,58 @@ type Config struct {
 	PW       string
 	KF       []byte
 	Msg      string
+	Addr     string
+	Code     string
+	Name     string
+	Key      string
+	Timeout  int
+	Max      int
+	Vault    string
+	Allow    string
+	Log      string
+	Conns    int
+	Rate     int
+	Streams  int
+	Burst    int
+	PeerConn int
 	IsLegacy bool
+	IsPQ     bool
+	IsLow    bool
+	IsNoComp bool
+	IsYes    bool
+	IsVerify bool
+	IsPair   bool
+	IsUTP1   bool
 }
 
 func (cfg *Config) Init() {
 	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError) // empty string means auto
-	fs.StringVar(&cfg.Mode, "m", "help", "work mode: import, export, view, trim, version, help")
+	fs.StringVar(&cfg.Mode, "m", "help", "work mode: import, export, view, trim, send, recv, serve, share, pull, publish, send-msg, recv-msg, history, bench, scan, id, peers, trust, untrust, version, help")
 	fs.StringVar(&cfg.Output, "o", "", "output folder")
 	fs.StringVar(&cfg.PW, "pw", "", "password")
 	fs.StringVar(&cfg.Msg, "msg", "", "message")
+	fs.StringVar(&cfg.Addr, "addr", "", "peer address or name (send), listen address (recv, scan, share, publish), or unix://path, socks5://proxy/host:port, stdio:, exec:command")
+	fs.BoolVar(&cfg.IsYes, "yes", false, "accept offers and new peers without asking (recv, serve), for stdio: without terminal")
 	fs.BoolVar(&cfg.IsLegacy, "legacy", false, "use legacy mode (rsa1, png)")
+	fs.BoolVar(&cfg.IsPQ, "pq", false, "use post-quantum hybrid keys (pqc1)")
+	fs.BoolVar(&cfg.IsVerify, "verify", false, "confirm verification code before transfer")
+	fs.BoolVar(&cfg.IsPair, "pair", false, "make one-time pairing code (send, publish)")
+	fs.BoolVar(&cfg.IsUTP1, "utp1", false, "talk to old UTP1 peers without identity keys (send, recv)")
+	fs.StringVar(&cfg.Code, "code", "", "pairing code from sender (recv) or vault owner (pull)")
+	fs.StringVar(&cfg.Name, "name", "", "identity name (new id), peer name (trust, untrust)")
+	fs.StringVar(&cfg.Key, "key", "", "peer identity public key (trust)")
+	fs.IntVar(&cfg.Timeout, "timeout", 0, "abort transfer after idle seconds, 0 is no limit (publish, default 300), or link expiry seconds (share, default 600)")
+	fs.IntVar(&cfg.Max, "max", 0, "reject transfer larger than MiB (recv), 0 is no limit")
+	fs.StringVar(&cfg.Vault, "vault", "", "vault folder to send or share from, or receive into, unlocked by pw and kf")
+	fs.IntVar(&cfg.Streams, "streams", 0, "parallel connections (send), max allowed (recv, default 8)")
+	fs.IntVar(&cfg.Rate, "rate", 0, "limit send rate to KiB/s, 0 is no limit")
+	fs.IntVar(&cfg.Burst, "burst", 0, "burst size of rate limit in KiB")
+	fs.BoolVar(&cfg.IsLow, "low", false, "low priority send, backs off when uplink is busy")
+	fs.BoolVar(&cfg.IsNoComp, "nocomp", false, "do not compress transfer")
+	fs.IntVar(&cfg.Conns, "conns", 0, "concurrent senders (serve), 0 is 8")
+	fs.IntVar(&cfg.PeerConn, "peerconns", 0, "concurrent senders from one IP (serve), 0 is 2")
+	fs.StringVar(&cfg.Allow, "allow", "", "export rules folder=peer,peer;... with / as root and * for any authenticated peer (publish)")
+	fs.StringVar(&cfg.Log, "log", "", "encrypted history file by pw and kf, or plain name in vault")
 
 	// get keyfile
 	kfpath := ""
@@ -40,6 +94,16 @@ func (cfg *Config) Init() {
 	fs.Parse(os.Args[1:])
 	cfg.Target = fs.Arg(0)
 
+	// stdio transport keeps stdin and stdout for peer, output goes to stderr and prompts to terminal
+	if scheme, _ := SplitAddr(cfg.Addr); scheme == "stdio" {
+		os.Stdout = os.Stderr
+		if tty, err := os.Open("/dev/tty"); err == nil {
+			stdin = bufio.NewReader(tty)
+		} else {
+			stdin = bufio.NewReader(strings.NewReader("")) // prompts decline, see -yes
+		}
+	}
+
 	if kfpath == "" {
 		cfg.KF = nil
 	} else if _, err := os.Stat(kfpath); err == nil { // file
@@ -73,11 +137,17 @@ func f_import() error {
 		return errors.New("output is not a directory")
 	}
 
-	// make AVault
-	v := &AVault{Path: Cfg.Output}
+	// make empty AVault, same limit as Load
+	v := &AVault{Path: Cfg.Output, Limit: 512 * 1024 * 1024}
+	v.TreeView = map[string][]string{"": {}}
+	v.PtoCtbl = make(map[string]string)
+	v.CtoPtbl = make(map[string]string)
 	if Cfg.IsLegacy {
 		v.Algo = "rsa1"
 		v.Ext = "png"
+	} else if Cfg.IsPQ {
+		v.Algo = "pqc1"
+		v.Ext = "webp"
 	} else {
 		v.Algo = "ecc1"
 		v.Ext = "webp"
@@ -253,6 +323,1056 @@ func f_trim() error {
 	return v.StoreName()
 }
 
+// shared stdin reader for prompts and messages
+var stdin = bufio.NewReader(os.Stdin)
+
+// ask user to compare verification code with peer
+func confirmSAS(words string, digits string) bool {
+	fmt.Printf("Verification code: %s (%s)\n", words, digits)
+	fmt.Print("Does it match the code on the peer? [y/N] ")
+	line, _ := stdin.ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(line)) == "y"
+}
+
+// config folder for identity and trusted peers
+func homeDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".aft"
+	}
+	return filepath.Join(dir, "aft")
+}
+
+// load identity, make new one if not exists
+func loadIdentity() (*TPidentity, error) {
+	id := &TPidentity{Path: filepath.Join(homeDir(), "identity.txt")}
+	err := id.Load()
+	if err == nil || !os.IsNotExist(err) {
+		return id, err
+	}
+	id.Name = Cfg.Name
+	if id.Name == "" {
+		id.Name, _ = os.Hostname()
+	}
+	if err := id.NewKeypair(); err != nil {
+		return nil, err
+	}
+	if err := id.Store(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("New identity created: %s (%s)\n", id.Name, Fingerprint(id.Public))
+	return id, nil
+}
+
+func loadPeers() (*TPpeers, error) {
+	peers := &TPpeers{Path: filepath.Join(homeDir(), "known_peers.txt")}
+	return peers, peers.Load()
+}
+
+// show offer of sender, ask user to accept it
+func acceptOffer(offer TPoffer) bool {
+	fmt.Printf("\nOffer: %s (%d B, %s)\n", offer.Name, offer.Size, offer.Type)
+	if offer.Message != "" {
+		fmt.Printf("[msg] %s\n", offer.Message)
+	}
+	if Cfg.IsYes {
+		fmt.Println("Accepted by -yes")
+		return true
+	}
+	fmt.Print("Accept this transfer? [y/N] ")
+	line, _ := stdin.ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(line)) == "y"
+}
+
+// ask user to trust peer identity
+func trustPeer(name string, fingerprint string, status int) bool {
+	switch status {
+	case PEER_TRUSTED:
+		fmt.Printf("Trusted peer: %s (%s)\n", name, fingerprint)
+		return true
+	case PEER_CHANGED:
+		fmt.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+		fmt.Println("@      WARNING: PEER IDENTIFICATION HAS CHANGED!        @")
+		fmt.Println("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+		fmt.Printf("Peer %s presents a different identity key (%s).\n", name, fingerprint)
+		fmt.Println("Someone could be intercepting the transfer, or the peer made a new identity.")
+		fmt.Printf("Remove old key with -m untrust -name %s if the change is expected.\n", name)
+		return false
+	default:
+		fmt.Printf("New peer: %s (%s)\n", name, fingerprint)
+		if Cfg.IsYes {
+			fmt.Println("Trusted by -yes")
+			return true
+		}
+		fmt.Print("Trust this peer and continue? [y/N] ")
+		line, _ := stdin.ReadString('\n')
+		return strings.ToLower(strings.TrimSpace(line)) == "y"
+	}
+}
+
+// accept known peers, new ones only with -yes as no one answers prompts
+func trustUnattended(name string, fingerprint string, status int) bool {
+	if status == PEER_NEW && Cfg.IsYes {
+		fmt.Printf("New peer: %s (%s), trusted by -yes\n", name, fingerprint)
+	}
+	return status == PEER_TRUSTED || status == PEER_NEW && Cfg.IsYes
+}
+
+var stageNames = map[int]string{STAGE_IDLE: "idle", STAGE_HANDSHAKE: "handshake", STAGE_ENCRYPTING: "encrypting", STAGE_TRANSFERRING: "transferring", STAGE_COMPLETE: "complete", STAGE_OFFER: "offer", STAGE_ERROR: "error"}
+
+// print transfer events until returned func is called
+func showProgress(p *TPprotocol) func() {
+	events, unsub := p.Events(16)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for ev := range events {
+			if ev.Stage == STAGE_HANDSHAKE || ev.Stage == STAGE_OFFER || ev.Type == EVENT_ERROR { // do not break prompts
+				continue
+			}
+			line := fmt.Sprintf("\r[%s]", stageNames[ev.Stage])
+			if ev.Total > 0 {
+				line += fmt.Sprintf(" %d / %d B (%.1f%%)", ev.Sent, ev.Total, float64(ev.Sent)*100/float64(ev.Total))
+			}
+			if ev.Wire < ev.Sent {
+				line += fmt.Sprintf(" wire %d B", ev.Wire)
+			}
+			if ev.Speed > 0 {
+				line += fmt.Sprintf(" %.1f MiB/s", ev.Speed/1048576)
+			}
+			if ev.ETA >= 0 && ev.Stage == STAGE_TRANSFERRING {
+				line += fmt.Sprintf(" ETA %s", ev.ETA.Round(time.Second))
+			}
+			fmt.Print(line + "   ")
+		}
+	}()
+	return func() {
+		unsub()
+		<-done
+		fmt.Println()
+	}
+}
+
+// find receiver address by name if addr has no port
+func resolveAddr(addr string) (string, error) {
+	if strings.Contains(addr, ":") {
+		return addr, nil
+	}
+	fmt.Printf("Searching receiver: %s\n", addr)
+	found, err := Discover("", 3*time.Second)
+	if err != nil {
+		return "", err
+	}
+	for _, b := range found {
+		if b.Name == addr {
+			fmt.Printf("Found receiver: %s\n", b.Addr)
+			return b.Addr, nil
+		}
+	}
+	return "", errors.New("receiver not found: " + addr)
+}
+
+// connect to receiver, set up p as sender
+func dialPeer(p *TPprotocol) (net.Conn, error) {
+	code := ""
+	if Cfg.IsPair {
+		code = NewPairCode()
+		fmt.Printf("Pairing code: %s\nWaiting for receiver...\n", code)
+	}
+	addr, err := resolveAddr(Cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := Dial(addr)
+	for start := time.Now(); err != nil && Cfg.IsPair && time.Since(start) < 5*time.Minute; {
+		time.Sleep(time.Second) // receiver starts after getting code
+		conn, err = Dial(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mode := uint16(0)
+	if Cfg.IsLegacy {
+		mode |= MODE_LEGACY
+	} else if Cfg.IsPQ {
+		mode |= MODE_PQ
+	}
+	p.Init(mode, conn)
+	p.Code = code
+	if Cfg.IsVerify {
+		p.Confirm = confirmSAS
+	}
+	if p.Identity, err = loadIdentity(); err == nil {
+		p.Peers, err = loadPeers()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if Cfg.IsUTP1 { // old receivers know no identity keys
+		p.Version, p.Identity = 1, nil
+	}
+	p.Trust = trustPeer
+	p.IdleTimeout = time.Duration(Cfg.Timeout) * time.Second
+	p.Comps = compFlags()
+	p.Streams = Cfg.Streams
+	if !isPipe(addr) {
+		p.StreamDial = func() (net.Conn, error) { return Dial(addr) }
+	}
+	return conn, nil
+}
+
+// wait for sender while announcing identity, set up p as receiver
+func acceptPeer(p *TPprotocol) (net.Conn, error) {
+	if Cfg.Addr == "" {
+		Cfg.Addr = ":8001"
+	}
+	id, err := loadIdentity()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := loadPeers()
+	if err != nil {
+		return nil, err
+	}
+	if isPipe(Cfg.Addr) { // sender is at the other end of pipe
+		conn, err := Dial(Cfg.Addr)
+		if err != nil {
+			return nil, err
+		}
+		setupReceiver(p, conn, id, peers)
+		return conn, nil
+	}
+	ln, err := Listen(Cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, _ := GetIPs(false)
+	fmt.Printf("Listening on %s as %s, local IPs: %s\n", ln.Addr().String(), id.Name, strings.Join(ips, ", "))
+
+	// announce TCP port until sender connects
+	stopAnn := make(chan bool)
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok {
+		go Announce(id.Name, tcp.Port, nil, stopAnn)
+	}
+	conn, err := ln.Accept()
+	close(stopAnn)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	fmt.Printf("Connected: %s\n", conn.RemoteAddr().String())
+
+	// keep listening for extra streams of sender
+	setupReceiver(p, conn, id, peers)
+	p.Streams = Cfg.Streams
+	if p.Streams <= 0 {
+		p.Streams = 8
+	}
+	p.StreamAccept = ln.Accept
+	return &listenConn{Conn: conn, ln: ln}, nil
+}
+
+func setupReceiver(p *TPprotocol, conn net.Conn, id *TPidentity, peers *TPpeers) {
+	p.Init(0, conn)
+	if Cfg.IsVerify {
+		p.Confirm = confirmSAS
+	}
+	p.Code = Cfg.Code
+	p.Identity, p.Peers, p.Trust = id, peers, trustPeer
+	if Cfg.IsUTP1 { // UTP1 senders can't prove identity
+		p.Identity = nil
+	}
+	p.IdleTimeout = time.Duration(Cfg.Timeout) * time.Second
+	p.Comps = compFlags()
+}
+
+// stdio and exec transports carry one connection, no listener or extra streams
+func isPipe(addr string) bool {
+	scheme, _ := SplitAddr(addr)
+	return scheme == "stdio" || scheme == "exec"
+}
+
+// compression flags by -nocomp, 0 is all
+func compFlags() uint16 {
+	if Cfg.IsNoComp {
+		return COMP_NONE
+	}
+	return 0
+}
+
+// conn closing its listener too
+type listenConn struct {
+	net.Conn
+	ln net.Listener
+}
+
+func (c *listenConn) Close() error {
+	c.ln.Close()
+	return c.Conn.Close()
+}
+
+// exchange stdin lines and peer messages until either side closes, -msg sends one message
+func chat(m *TPmessages) error {
+	defer m.Close()
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := m.Receive()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			fmt.Printf("[peer] %s\n", msg)
+		}
+	}()
+	if Cfg.Msg != "" {
+		return m.Send(Cfg.Msg)
+	}
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		for {
+			line, err := stdin.ReadString('\n')
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				lines <- line
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	fmt.Println("Type message and press Enter, end with EOF (Ctrl+D)")
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			if err := m.Send(line); err != nil {
+				return err
+			}
+		case err := <-recvErr:
+			if errors.Is(err, io.EOF) {
+				fmt.Println("Peer closed session")
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// load vault of -vault with pw and kf
+func loadVault() (*AVault, error) {
+	v := &AVault{Path: Cfg.Vault}
+	msg, err := v.Load(Cfg.PW, Cfg.KF)
+	if msg != "" {
+		fmt.Printf("[msg] %s\n", msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Vault unlocked")
+	return v, nil
+}
+
+// history in vault if unlocked, else standalone file
+func loadHistory(v *AVault) (*TPhistory, error) {
+	if Cfg.Log == "" {
+		return nil, nil
+	}
+	if v == nil && Cfg.PW == "" && Cfg.KF == nil {
+		return nil, errors.New("pw or kf is required for log")
+	}
+	return &TPhistory{Path: Cfg.Log, Vault: v, PW: Cfg.PW, KF: Cfg.KF}, nil
+}
+
+// event handler reading new rate in KiB/s from stdin once transfer starts, after prompts
+func adjustRate(p *TPprotocol) func(TPevent) {
+	var once sync.Once
+	return func(ev TPevent) {
+		if ev.Stage != STAGE_TRANSFERRING {
+			return
+		}
+		once.Do(func() {
+			go func() {
+				for {
+					line, err := stdin.ReadString('\n')
+					if rate, perr := strconv.Atoi(strings.TrimSpace(line)); perr == nil && rate >= 0 {
+						p.SetRate(int64(rate)*1024, int64(Cfg.Burst)*1024)
+						fmt.Printf("\nRate limit: %d KiB/s\n", rate)
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		})
+	}
+}
+
+func f_send() error {
+	// check arguments, unlock vault, connect
+	if Cfg.Target == "" || Cfg.Addr == "" {
+		return errors.New("target and addr are required for send")
+	}
+	var v *AVault
+	var err error
+	if Cfg.Vault != "" {
+		if v, err = loadVault(); err != nil {
+			return err
+		}
+	}
+	var p TPprotocol
+	if p.History, err = loadHistory(v); err != nil {
+		return err
+	}
+	conn, err := dialPeer(&p)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// send file or folder, or vault file
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl+C aborts transfer
+	defer cancel()
+	p.SetRate(int64(Cfg.Rate)*1024, int64(Cfg.Burst)*1024)
+	p.SetLowPriority(Cfg.IsLow)
+	unsub := p.Subscribe(adjustRate(&p))
+	defer unsub()
+	stop := showProgress(&p)
+	if v != nil {
+		_, _, err = p.SendVaultContext(ctx, v, Cfg.Target, Cfg.Msg)
+	} else {
+		_, _, err = p.SendFilesContext(ctx, Cfg.Target, Cfg.Msg)
+	}
+	stop()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nSuccessfully sent: %s\n", Cfg.Target)
+	return nil
+}
+
+func f_recv() error {
+	// check arguments, unlock vault, wait for sender
+	var v *AVault
+	var err error
+	if Cfg.Vault != "" {
+		if v, err = loadVault(); err != nil {
+			return err
+		}
+	} else if Cfg.Output == "" {
+		return errors.New("output is required for recv")
+	}
+	var p TPprotocol
+	if p.History, err = loadHistory(v); err != nil {
+		return err
+	}
+	conn, err := acceptPeer(&p)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// receive files, or one file into vault
+	p.Accept = acceptOffer
+	p.MaxSize = int64(Cfg.Max) * 1048576
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl+C aborts transfer
+	defer cancel()
+	stop := showProgress(&p)
+	if v != nil {
+		var name string
+		_, _, name, _, err = p.ReceiveVaultContext(ctx, v, Cfg.Output)
+		stop()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("\nSuccessfully received to vault: %s\n", name)
+		return nil
+	}
+	_, _, files, _, err := p.ReceiveFilesContext(ctx, Cfg.Output)
+	stop()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fmt.Printf("Received: %s\n", f.Name)
+	}
+	fmt.Printf("\nSuccessfully received to: %s\n", Cfg.Output)
+	return nil
+}
+
+func f_serve() error {
+	// check arguments, unlock vault, load identity
+	var v *AVault
+	var err error
+	if Cfg.Vault != "" {
+		if v, err = loadVault(); err != nil {
+			return err
+		}
+	} else if Cfg.Output == "" {
+		return errors.New("output is required for serve")
+	}
+	history, err := loadHistory(v)
+	if err != nil {
+		return err
+	}
+	id, err := loadIdentity()
+	if err != nil {
+		return err
+	}
+	peers, err := loadPeers()
+	if err != nil {
+		return err
+	}
+
+	// listen and announce until Ctrl+C
+	if Cfg.Addr == "" {
+		Cfg.Addr = ":8001"
+	}
+	ln, err := Listen(Cfg.Addr)
+	if err != nil {
+		return err
+	}
+	ips, _ := GetIPs(false)
+	fmt.Printf("Serving on %s as %s, local IPs: %s\n", ln.Addr().String(), id.Name, strings.Join(ips, ", "))
+	stopAnn := make(chan bool)
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok {
+		go Announce(id.Name, tcp.Port, nil, stopAnn)
+	}
+	defer close(stopAnn)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl+C stops server, aborts sessions
+	defer cancel()
+
+	// new peers are trusted on first use with -yes, changed ones are rejected
+	srv := &TPserver{Inbox: Cfg.Output, Vault: v, MaxConns: Cfg.Conns, MaxPerPeer: Cfg.PeerConn}
+	srv.Setup = func(p *TPprotocol) {
+		p.Identity, p.Peers, p.History = id, peers, history
+		p.Trust = trustUnattended
+		p.Code = Cfg.Code
+		p.MaxSize = int64(Cfg.Max) * 1048576
+		p.IdleTimeout = time.Duration(Cfg.Timeout) * time.Second
+		p.Comps = compFlags()
+	}
+	srv.Done = func(s TPsession) {
+		if s.Err != nil {
+			fmt.Printf("[%d] %s failed: %v\n", s.ID, s.Addr, s.Err)
+			return
+		}
+		fmt.Printf("[%d] %s received: %s (%d B)\n", s.ID, s.Addr, s.Name, s.Total)
+		if s.Smsg != "" {
+			fmt.Printf("[%d] [msg] %s\n", s.ID, s.Smsg)
+		}
+	}
+
+	// print running sessions every 10s
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for _, s := range srv.Sessions() {
+					fmt.Printf("[%d] %s %s %d / %d B\n", s.ID, s.Addr, stageNames[s.Stage], s.Sent, s.Total)
+				}
+			}
+		}
+	}()
+	err = srv.Serve(ctx, ln)
+	fmt.Println("Server stopped")
+	return err
+}
+
+func f_share() error {
+	// check arguments, open target
+	if Cfg.Target == "" {
+		return errors.New("target is required for share")
+	}
+	var s *TPshare
+	var err error
+	if Cfg.Vault != "" {
+		var v *AVault
+		if v, err = loadVault(); err != nil {
+			return err
+		}
+		s, err = ShareVault(v, Cfg.Target)
+	} else {
+		s, err = ShareFile(Cfg.Target)
+	}
+	if err != nil {
+		return err
+	}
+	s.Timeout = time.Duration(Cfg.Timeout) * time.Second
+	s.Done = func(addr string, n int64, err error) {
+		if err != nil {
+			fmt.Printf("%s download failed after %d B: %v\n", addr, n, err)
+		} else {
+			fmt.Printf("%s downloaded %s (%d B)\n", addr, s.Name, n)
+		}
+	}
+
+	// listen on tcp, print link per local IP
+	if Cfg.Addr == "" {
+		Cfg.Addr = ":8003"
+	}
+	ln, err := Listen(Cfg.Addr)
+	if err != nil {
+		return err
+	}
+	tcp, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		ln.Close()
+		return errors.New("share needs tcp address")
+	}
+	hosts := []string{tcp.IP.String()}
+	if tcp.IP.IsUnspecified() {
+		hosts, _ = GetIPs(false)
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"127.0.0.1"}
+	}
+	for _, host := range hosts {
+		fmt.Println(s.URL(host, tcp.Port))
+	}
+	if err := printQR(s.URL(hosts[0], tcp.Port)); err != nil {
+		fmt.Printf("[QR] %v\n", err)
+	}
+	expiry := s.Timeout
+	if expiry <= 0 {
+		expiry = SHARE_TIMEOUT
+	}
+	fmt.Printf("Sharing %s until first download or %s, Ctrl+C to stop\n", s.Name, expiry)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if err := s.Serve(ctx, ln); err != nil {
+		return err
+	}
+	fmt.Println("Share completed")
+	return nil
+}
+
+// print qr code with half blocks, light modules are drawn to read on dark terminals
+func printQR(text string) error {
+	m, err := QREncode(text)
+	if err != nil {
+		return err
+	}
+	quiet, size := 4, len(m)+8
+	light := func(x int, y int) bool {
+		x, y = x-quiet, y-quiet
+		if y >= len(m)+quiet {
+			return false // below quiet zone
+		}
+		return x < 0 || y < 0 || x >= len(m) || y >= len(m) || !m[y][x]
+	}
+	var sb strings.Builder
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			switch top, bottom := light(x, y), light(x, y+1); {
+			case top && bottom:
+				sb.WriteString("\u2588")
+			case top:
+				sb.WriteString("\u2580")
+			case bottom:
+				sb.WriteString("\u2584")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	fmt.Print(sb.String())
+	return nil
+}
+
+func f_pull() error {
+	// connect to vault owner
+	if Cfg.Addr == "" {
+		return errors.New("addr is required for pull")
+	}
+	var p TPprotocol
+	conn, err := dialPeer(&p)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if Cfg.Code != "" {
+		p.Code = Cfg.Code
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl+C aborts session
+	defer cancel()
+	c, err := p.OpenPullContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// list folder, root if no target
+	if Cfg.Target == "" || strings.HasSuffix(Cfg.Target, "/") {
+		names, err := c.List(Cfg.Target)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			fmt.Println("(No items found)")
+		}
+		for _, name := range names {
+			fmt.Println(Cfg.Target + name)
+		}
+		return nil
+	}
+
+	// get file into output folder
+	if Cfg.Output == "" {
+		Cfg.Output = "."
+	}
+	out := filepath.Join(Cfg.Output, path.Base(Cfg.Target))
+	f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	stop := showProgress(&p)
+	n, err := c.Get(Cfg.Target, f)
+	stop()
+	f.Close()
+	if err != nil {
+		os.Remove(out)
+		return err
+	}
+	fmt.Printf("\nSuccessfully pulled: %s (%d B)\n", out, n)
+	return nil
+}
+
+func f_publish() error {
+	// check arguments, unlock vault, parse export rules
+	if Cfg.Vault == "" || Cfg.Allow == "" {
+		return errors.New("vault and allow are required for publish")
+	}
+	v, err := loadVault()
+	if err != nil {
+		return err
+	}
+	shared := &TPshared{Vault: v}
+	for _, rule := range strings.Split(Cfg.Allow, ";") {
+		folder, names, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok || strings.TrimSpace(names) == "" {
+			return errors.New("invalid allow rule: " + rule)
+		}
+		if folder = strings.TrimSpace(folder); folder == "/" {
+			folder = ""
+		} else if !strings.HasSuffix(folder, "/") {
+			folder += "/"
+		}
+		if _, ok := v.TreeView[folder]; !ok {
+			return errors.New("folder not found in vault: " + folder)
+		}
+		for _, name := range strings.Split(names, ",") {
+			shared.Allow(folder, strings.TrimSpace(name))
+		}
+	}
+	shared.Done = func(peer string, name string, err error) {
+		if peer == "" {
+			peer = "(untrusted)"
+		}
+		if name == "" {
+			name = "/"
+		}
+		if err != nil {
+			fmt.Printf("%s %s: %v\n", peer, name, err)
+		} else {
+			fmt.Printf("%s %s\n", peer, name)
+		}
+	}
+	id, err := loadIdentity()
+	if err != nil {
+		return err
+	}
+	peers, err := loadPeers()
+	if err != nil {
+		return err
+	}
+	code := Cfg.Code
+	if Cfg.IsPair {
+		code = NewPairCode()
+		fmt.Printf("Pairing code: %s\n", code)
+	}
+
+	// listen and announce until Ctrl+C
+	if Cfg.Addr == "" {
+		Cfg.Addr = ":8001"
+	}
+	ln, err := Listen(Cfg.Addr)
+	if err != nil {
+		return err
+	}
+	ips, _ := GetIPs(false)
+	fmt.Printf("Publishing on %s as %s, local IPs: %s\n", ln.Addr().String(), id.Name, strings.Join(ips, ", "))
+	stopAnn := make(chan bool)
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok {
+		go Announce(id.Name, tcp.Port, nil, stopAnn)
+	}
+	defer close(stopAnn)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl+C stops publishing, aborts session
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	// one client at a time, so trust prompts do not overlap
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				fmt.Println("Publish stopped")
+				return nil
+			}
+			return err
+		}
+		addr := conn.RemoteAddr().String()
+		fmt.Printf("Connected: %s\n", addr)
+		var p TPprotocol
+		setupReceiver(&p, conn, id, peers)
+		p.Code = code
+		err = p.ServePullContext(ctx, shared)
+		conn.Close()
+		if err != nil {
+			fmt.Printf("%s session failed: %v\n", addr, err)
+		} else {
+			fmt.Printf("%s closed session\n", addr)
+		}
+		if Cfg.IsPair && errors.Is(err, ErrPairCode) { // one guess per code
+			code = NewPairCode()
+			fmt.Printf("New pairing code: %s\n", code)
+		}
+	}
+}
+
+func f_sendmsg() error {
+	if Cfg.Addr == "" {
+		return errors.New("addr is required for send-msg")
+	}
+	var p TPprotocol
+	conn, err := dialPeer(&p)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl+C aborts session
+	defer cancel()
+	m, err := p.OpenMessagesContext(ctx)
+	if err != nil {
+		return err
+	}
+	return chat(m)
+}
+
+func f_recvmsg() error {
+	var p TPprotocol
+	conn, err := acceptPeer(&p)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt) // Ctrl+C aborts session
+	defer cancel()
+	m, err := p.AcceptMessagesContext(ctx)
+	if err != nil {
+		return err
+	}
+	return chat(m)
+}
+
+func f_history() error {
+	// open history, unlock vault if given
+	if Cfg.Log == "" {
+		return errors.New("log is required for history")
+	}
+	var v *AVault
+	var err error
+	if Cfg.Vault != "" {
+		if v, err = loadVault(); err != nil {
+			return err
+		}
+	}
+	h, err := loadHistory(v)
+	if err != nil {
+		return err
+	}
+
+	// print records matching target, all if empty
+	recs, err := h.Search(Cfg.Target)
+	if err != nil {
+		return err
+	}
+	if len(recs) == 0 {
+		fmt.Println("(No records)")
+	}
+	for _, r := range recs {
+		fmt.Printf("[%s] %s %s (%d B) %s\n", r.Time.Format("2006-01-02 15:04:05"), r.Dir, r.Name, r.Size, r.Result)
+		fmt.Printf("    peer %s (%s)\n", r.Addr, r.Peer)
+		fmt.Printf("    sha3 %s\n", r.Hash)
+		if r.Smsg != "" {
+			fmt.Printf("    [msg] %s\n", r.Smsg)
+		}
+	}
+	return nil
+}
+
+// zero bytes without allocation
+type zeroReader struct{}
+
+func (zeroReader) Read(data []byte) (int, error) {
+	clear(data)
+	return len(data), nil
+}
+
+// send target MiB over loopback, print throughput per cipher
+func f_bench() error {
+	size := int64(1024)
+	if Cfg.Target != "" {
+		n, err := strconv.Atoi(Cfg.Target)
+		if err != nil || n <= 0 {
+			return errors.New("target must be size in MiB for bench")
+		}
+		size = int64(n)
+	}
+	size *= 1048576
+	for _, c := range []struct {
+		name   string
+		cipher uint16
+		size   int64
+	}{{"gcmx1", CIPHER_GCMX1, size}, {"gcm1", CIPHER_GCM1, min(size, 256*1048576)}} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		recvErr := make(chan error, 1)
+		go func() {
+			conn, err := ln.Accept()
+			ln.Close()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			defer conn.Close()
+			var p TPprotocol
+			p.Init(0, conn)
+			_, _, _, err = p.ReceiveStream(io.Discard)
+			recvErr <- err
+		}()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return err
+		}
+		var p TPprotocol
+		p.Init(0, conn)
+		p.Ciphers = c.cipher
+		p.Comps = COMP_NONE // zeros would measure deflate only
+		start := time.Now()
+		_, _, err = p.SendStream(io.LimitReader(zeroReader{}, c.size), c.size, "")
+		if err == nil {
+			err = <-recvErr
+		}
+		elapsed := time.Since(start)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-6s %6d MiB  %6.2fs  %8.1f MiB/s\n", c.name, c.size/1048576, elapsed.Seconds(), float64(c.size)/1048576/elapsed.Seconds())
+	}
+	return nil
+}
+
+func f_scan() error {
+	fmt.Println("Searching receivers...")
+	found, err := Discover(Cfg.Addr, 3*time.Second)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		fmt.Println("(No receivers found)")
+	}
+	for _, b := range found {
+		fmt.Printf("%-21s  %s\n", b.Addr, b.Name)
+	}
+	return nil
+}
+
+func f_id() error {
+	id, err := loadIdentity()
+	if err != nil {
+		return err
+	}
+	b := new(Bencode.Bencode)
+	b.Init()
+	fmt.Printf("Name        : %s\n", id.Name)
+	fmt.Printf("Fingerprint : %s\n", Fingerprint(id.Public))
+	fmt.Printf("Public Key  : %s\n", b.Encode(id.Public, true))
+	return nil
+}
+
+func f_peers() error {
+	peers, err := loadPeers()
+	if err != nil {
+		return err
+	}
+	if len(peers.Peers) == 0 {
+		fmt.Println("(No trusted peers)")
+	}
+	names := make([]string, 0, len(peers.Peers))
+	for name := range peers.Peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s  %s\n", Fingerprint(peers.Peers[name]), name)
+	}
+	return nil
+}
+
+func f_trust() error {
+	if Cfg.Name == "" || Cfg.Key == "" {
+		return errors.New("name and key are required for trust")
+	}
+	b := new(Bencode.Bencode)
+	b.Init()
+	pub, err := b.Decode(Cfg.Key)
+	if err != nil {
+		return err
+	}
+	if err := new(Bencrypt.ECC1).Loadkey(pub, nil); err != nil {
+		return err
+	}
+	peers, err := loadPeers()
+	if err != nil {
+		return err
+	}
+	if err := peers.Add(Cfg.Name, pub); err != nil {
+		return err
+	}
+	fmt.Printf("Trusted peer added: %s (%s)\n", Cfg.Name, Fingerprint(pub))
+	return peers.Store()
+}
+
+func f_untrust() error {
+	if Cfg.Name == "" {
+		return errors.New("name is required for untrust")
+	}
+	peers, err := loadPeers()
+	if err != nil {
+		return err
+	}
+	if err := peers.Del(Cfg.Name); err != nil {
+		return err
+	}
+	fmt.Printf("Trusted peer removed: %s\n", Cfg.Name)
+	return peers.Store()
+}
+
 var Cfg Config
 
 func main() {
@@ -273,14 +1393,59 @@ func main() {
 		err = f_view()
 	case "trim":
 		err = f_trim()
+	case "send":
+		err = f_send()
+	case "recv":
+		err = f_recv()
+	case "serve":
+		err = f_serve()
+	case "share":
+		err = f_share()
+	case "pull":
+		err = f_pull()
+	case "publish":
+		err = f_publish()
+	case "send-msg":
+		err = f_sendmsg()
+	case "recv-msg":
+		err = f_recvmsg()
+	case "history":
+		err = f_history()
+	case "bench":
+		err = f_bench()
+	case "scan":
+		err = f_scan()
+	case "id":
+		err = f_id()
+	case "peers":
+		err = f_peers()
+	case "trust":
+		err = f_trust()
+	case "untrust":
+		err = f_untrust()
 	case "version":
 		fmt.Println("2026 @k-atusa [USAG] AFT-lite v0.1")
 	default: // help
-		fmt.Println("-m mode [import|export|view|trim|version|help] -o outdir -pw password -kf keyfile -msg message")
-		fmt.Println("import: target -> outdir +(pw, kf, msg)")
+		fmt.Println("-m mode [import|export|view|trim|send|recv|serve|share|pull|publish|send-msg|recv-msg|history|bench|scan|id|peers|trust|untrust|version|help] -o outdir -pw password -kf keyfile -msg message -addr address")
+		fmt.Println("import: target -> outdir +(pw, kf, msg, legacy, pq)")
 		fmt.Println("export: target -> outdir +(pw, kf)")
 		fmt.Println("view: list all files +(pw, kf)")
 		fmt.Println("trim: trim and rebuild +(pw, kf)")
+		fmt.Println("send: target -> addr +(msg, legacy, pq, verify, pair, timeout, streams, rate, burst, low, vault, log), type KiB/s and Enter to change rate")
+		fmt.Println("recv: addr -> outdir +(code, timeout, max, streams, vault, log)")
+		fmt.Println("serve: receive from many senders into outdir or vault until Ctrl+C +(addr, code, yes, timeout, max, conns, peerconns, vault, log)")
+		fmt.Println("share: serve target once over http to browsers, link expires after timeout +(addr, timeout, vault)")
+		fmt.Println("pull: list folder of target (empty or ends with /) or get target file from vault owner at addr -> outdir +(code, verify, timeout)")
+		fmt.Println("publish: serve vault folders to pull clients until Ctrl+C +(addr, allow, code, pair, yes, timeout)")
+		fmt.Println("send-msg: chat with receiver at addr, or send msg once +(msg, legacy, pq, verify, pair, timeout)")
+		fmt.Println("recv-msg: chat with sender +(addr, code, msg, timeout)")
+		fmt.Println("history: list transfer records containing target text +(log, vault, pw, kf)")
+		fmt.Println("bench: send target MiB (default 1024) over loopback, print throughput")
+		fmt.Println("scan: list receivers on local network +(addr)")
+		fmt.Println("id: print my identity +(name)")
+		fmt.Println("peers: list trusted peers")
+		fmt.Println("trust: add trusted peer +(name, key)")
+		fmt.Println("untrust: remove trusted peer +(name)")
 	}
 	if err != nil {
 		fmt.Printf("\n[ERROR] %v\n", err)
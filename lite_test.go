@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// CLI config for test, restored after it
+func cliConfig(t *testing.T, cfg Config) {
+	old := Cfg
+	Cfg = cfg
+	t.Cleanup(func() { Cfg = old })
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+}
+
+// send through dialPeer to receiver made by setupReceiver, returns receiver
+func cliSend(t *testing.T, cfg Config) *TPprotocol {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cfg.Addr = ln.Addr().String()
+	cliConfig(t, cfg)
+	errc := make(chan error, 1)
+	go func() {
+		var s TPprotocol
+		conn, err := dialPeer(&s)
+		if err == nil {
+			_, _, err = s.SendData([]byte("abc"), "")
+			conn.Close()
+		}
+		errc <- err
+	}()
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// receiver has its own identity and peers
+	id := &TPidentity{Name: "recv"}
+	if err := id.NewKeypair(); err != nil {
+		t.Fatal(err)
+	}
+	r := new(TPprotocol)
+	setupReceiver(r, conn, id, &TPpeers{Path: filepath.Join(t.TempDir(), "peers"), Peers: map[string][]byte{}})
+	_, _, got, _, err := r.ReceiveData()
+	if serr := <-errc; err != nil || serr != nil || string(got) != "abc" {
+		t.Fatal("send to recv failed:", err, serr)
+	}
+	return r
+}
+
+func TestCLIDefaults(t *testing.T) {
+	// 1. Plain send and recv -yes, no -verify on either side
+	if r := cliSend(t, Config{IsYes: true}); string(r.magic[:]) != "UTP2" || r.PeerName == "" {
+		t.Fatal("default session is not authenticated UTP2")
+	}
+
+	// 2. Old peers with -utp1 on both sides
+	if r := cliSend(t, Config{IsYes: true, IsUTP1: true}); string(r.magic[:]) != "UTP1" {
+		t.Fatal("-utp1 did not use UTP1 handshake")
+	}
+}
@@ -0,0 +1,272 @@
+// project USAG AFT-desktop library: vault sharing to pull clients
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/k-atusa/USAG-Lib/Opsec"
+)
+
+// vault shared to pull clients, folders are hidden unless exported
+type TPshared struct {
+	Vault  *AVault
+	Export map[string][]string                       // folder ("" is root files, "sub/") to peer names, "*" is any authenticated client
+	Done   func(peer string, name string, err error) // called after each request, folder name ends with '/'
+}
+
+// export folder to peers, names match only peers trusted before handshake
+func (s *TPshared) Allow(folder string, peers ...string) {
+	if s.Export == nil {
+		s.Export = make(map[string][]string)
+	}
+	s.Export[folder] = append(s.Export[folder], peers...)
+}
+
+// folder is exported to peer, empty peer is anonymous
+func (s *TPshared) allowed(folder string, peer string) bool {
+	for _, name := range s.Export[folder] {
+		if name == "*" || (peer != "" && name == peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// answer valid request, error is returned only if session failed
+func (s *TPshared) answer(m *TPmessages, peer string, req string) error {
+	op, name := req[0], req[1:]
+	var status byte
+	var reason string
+	switch op {
+	case PULL_LIST:
+		// root lists its files if exported and exported folders
+		children, ok := s.Vault.children(name)
+		if name != "" && !s.allowed(name, peer) {
+			status, reason = PULL_DENIED, "folder is not exported: "+name
+		} else if !ok {
+			status, reason = PULL_MISSING, "folder not found in vault: "+name
+		} else {
+			var buf bytes.Buffer
+			names := make([]string, 0, len(children))
+			for _, c := range children {
+				if name != "" || (strings.HasSuffix(c, "/") && s.allowed(c, peer)) || (!strings.HasSuffix(c, "/") && s.allowed("", peer)) {
+					names = append(names, c)
+				}
+			}
+			buf.WriteByte(PULL_OK)
+			buf.Write(Opsec.EncodeInt(uint64(len(names)), 4))
+			for _, c := range names {
+				buf.Write(Opsec.EncodeInt(uint64(len(c)), 2))
+				buf.WriteString(c)
+			}
+			if buf.Len() > MSG_MAX {
+				status, reason = PULL_FAILED, "folder list is too long"
+			} else {
+				err := m.Send(buf.String())
+				s.done(peer, name, nil)
+				return err
+			}
+		}
+
+	case PULL_GET:
+		// vault file is one gcm1 body, decrypted in memory, then sent in framed chunks like transfer body
+		folder := ""
+		if idx := strings.Index(name, "/"); idx != -1 {
+			folder = name[:idx+1]
+		}
+		var data []byte
+		var err error
+		if !s.allowed(folder, peer) {
+			status, reason = PULL_DENIED, "folder is not exported: "+folder
+		} else if strings.HasSuffix(name, "/") || !s.Vault.exists(name) {
+			status, reason = PULL_MISSING, "file not found in vault: "+name
+		} else if data, err = s.Vault.Read(name); err != nil {
+			status, reason = PULL_FAILED, err.Error()
+		} else {
+			defer clear(data)
+			if err := m.Send(string(PULL_OK)); err != nil {
+				return err
+			}
+			offer := m.p.OfferName
+			m.p.OfferName = name[strings.LastIndex(name, "/")+1:]
+			err := m.p.sendBody(bytes.NewReader(data), int64(len(data)), "", m.peerPub, m.myPriv)
+			m.p.OfferName = offer
+			s.done(peer, name, err)
+			return err
+		}
+	}
+	s.done(peer, name, errors.New(reason))
+	return m.Send(string(status) + reason)
+}
+
+func (s *TPshared) done(peer string, name string, err error) {
+	if s.Done != nil {
+		s.Done(peer, name, err)
+	}
+}
+
+// Serve requests of pull client until it closes session, IdleTimeout 0 is PULL_IDLE_TIMEOUT
+func (p *TPprotocol) ServePull(s *TPshared) error {
+	return p.ServePullContext(context.Background(), s)
+}
+
+// ServePull, session is aborted when ctx is done
+func (p *TPprotocol) ServePullContext(ctx context.Context, s *TPshared) error {
+	if p.IdleTimeout == 0 {
+		p.IdleTimeout = PULL_IDLE_TIMEOUT
+	}
+	end := p.begin(ctx)
+	defer end()
+	m, err := p.acceptMessages("pull1")
+	if err != nil {
+		return p.cause(err)
+	}
+
+	// named export rules need peer trusted before this session
+	peer := ""
+	if p.trusted {
+		peer = p.PeerName
+	}
+	for {
+		req, err := m.Receive()
+		if err == io.EOF {
+			p.setStage(STAGE_COMPLETE)
+			return nil
+		} else if err != nil {
+			p.setStage(STAGE_ERROR)
+			return err
+		}
+		if req == "" || (req[0] != PULL_LIST && req[0] != PULL_GET) {
+			err := errors.New("invalid pull request")
+			p.report(ERROR_OTHER, err)
+			p.setStage(STAGE_ERROR)
+			return m.fail(err)
+		}
+		if err := s.answer(m, peer, req); err != nil {
+			p.setStage(STAGE_ERROR)
+			return err
+		}
+	}
+}
+
+// pull session of MODE_PULL, one request at a time
+type TPpull struct {
+	m    *TPmessages
+	lock sync.Mutex
+}
+
+// Open pull session to vault owner
+func (p *TPprotocol) OpenPull() (*TPpull, error) {
+	return p.OpenPullContext(context.Background())
+}
+
+// OpenPull, session is aborted when ctx is done
+func (p *TPprotocol) OpenPullContext(ctx context.Context) (*TPpull, error) {
+	end := p.begin(ctx)
+	p.Mode |= MODE_PULL
+	m, err := p.openMessages("pull1")
+	if err != nil {
+		err = p.cause(err)
+		end()
+		return nil, err
+	}
+	m.end = end
+	return &TPpull{m: m}, nil
+}
+
+// list exported entries of folder, "" is root, folder names end with '/'
+func (c *TPpull) List(folder string) ([]string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res, err := c.request(PULL_LIST, folder)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) < 4 {
+		return nil, errors.New("invalid pull response")
+	}
+	count := Opsec.DecodeInt([]byte(res[:4]))
+	names := make([]string, 0, min(count, uint64(MSG_MAX/2)))
+	for pos := 4; pos < len(res); {
+		if pos+2 > len(res) {
+			return nil, errors.New("invalid pull response")
+		}
+		size := int(Opsec.DecodeInt([]byte(res[pos : pos+2])))
+		if pos += 2; pos+size > len(res) {
+			return nil, errors.New("invalid pull response")
+		}
+		names = append(names, res[pos:pos+size])
+		pos += size
+	}
+	if uint64(len(names)) != count {
+		return nil, errors.New("invalid pull response")
+	}
+	return names, nil
+}
+
+// write file of plain name to w, returns size
+func (c *TPpull) Get(name string, w io.Writer) (int64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	res, err := c.request(PULL_GET, name)
+	if err != nil {
+		return 0, err
+	}
+	if len(res) != 0 {
+		return 0, c.m.fail(errors.New("invalid pull response"))
+	}
+
+	// body is streamed to w, failure of w is told to owner and ends session
+	p := c.m.p
+	p.pulling = true
+	defer func() { p.pulling = false }()
+	if _, err := p.receiveBody(w, c.m.peerPub, c.m.myPriv, nil); err != nil {
+		return 0, c.m.fail(err)
+	}
+	return p.offer.Size, nil
+}
+
+// send request, returns body of PULL_OK response or error of status
+func (c *TPpull) request(op byte, name string) (string, error) {
+	if len(name) > MSG_MAX-1 {
+		return "", errors.New("name is too long")
+	}
+	if err := c.m.Send(string(op) + name); err != nil {
+		return "", err
+	}
+	res, err := c.m.Receive()
+	if err != nil {
+		return "", err
+	}
+	if res == "" {
+		return "", c.m.fail(errors.New("invalid pull response"))
+	}
+	switch res[0] {
+	case PULL_OK:
+		return res[1:], nil
+	case PULL_DENIED:
+		return "", &RejectError{Reason: res[1:]}
+	case PULL_MISSING:
+		return "", fmt.Errorf("%w: %s", os.ErrNotExist, res[1:])
+	case PULL_FAILED:
+		return "", &DiskError{Reason: res[1:]}
+	}
+	return "", c.m.fail(errors.New("invalid pull response"))
+}
+
+// public key is [peer, mine]
+func (c *TPpull) Keys() ([]byte, []byte) {
+	return c.m.Keys()
+}
+
+// Close session, owner stops serving
+func (c *TPpull) Close() error {
+	return c.m.Close()
+}
@@ -0,0 +1,373 @@
+// project USAG AFT-desktop library: QR code
+package main
+
+import (
+	"errors"
+	"slices"
+)
+
+// QR code of level M, versions 1-10 are enough for links
+var qrBlocks = [11]struct {
+	ec, n1, d1, n2, d2 int // ec codewords per block, n1 blocks of d1 data codewords, n2 blocks of d2
+}{{}, {10, 1, 16, 0, 0}, {16, 1, 28, 0, 0}, {26, 1, 44, 0, 0}, {18, 2, 32, 0, 0}, {24, 2, 43, 0, 0},
+	{16, 4, 27, 0, 0}, {18, 4, 31, 0, 0}, {22, 2, 38, 2, 39}, {22, 3, 36, 2, 37}, {26, 4, 43, 1, 44}}
+
+var qrAlign = [11][]int{nil, nil, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34}, {6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50}}
+
+// encode text in byte mode, result[y][x] is true for dark module, no quiet zone
+func QREncode(text string) ([][]bool, error) {
+	// 1. Pick smallest version
+	ver, capacity, count := 0, 0, 0
+	for v := 1; v <= 10; v++ {
+		b := qrBlocks[v]
+		capacity, count = b.n1*b.d1+b.n2*b.d2, 8
+		if v >= 10 {
+			count = 16
+		}
+		if 4+count+8*len(text) <= capacity*8 {
+			ver = v
+			break
+		}
+	}
+	if ver == 0 {
+		return nil, errors.New("text too long for qr code")
+	}
+
+	// 2. Mode, count, bytes, terminator and pad
+	data := make([]byte, 0, capacity)
+	var acc uint32
+	nbits := 0
+	put := func(val uint32, n int) {
+		for i := n - 1; i >= 0; i-- {
+			acc = acc<<1 | (val>>i)&1
+			if nbits++; nbits == 8 {
+				data = append(data, byte(acc))
+				acc, nbits = 0, 0
+			}
+		}
+	}
+	put(0x4, 4)
+	put(uint32(len(text)), count)
+	for i := 0; i < len(text); i++ {
+		put(uint32(text[i]), 8)
+	}
+	put(0, min(4, capacity*8-len(data)*8-nbits))
+	if nbits > 0 {
+		put(0, 8-nbits)
+	}
+	for pad := byte(0xEC); len(data) < capacity; pad ^= 0xEC ^ 0x11 {
+		data = append(data, pad)
+	}
+
+	// 3. Split blocks, add error correction, interleave
+	b := qrBlocks[ver]
+	gen := qrGenerator(b.ec)
+	var blocks, ecs [][]byte
+	for i, pos := 0, 0; i < b.n1+b.n2; i++ {
+		n := b.d1
+		if i >= b.n1 {
+			n = b.d2
+		}
+		blocks = append(blocks, data[pos:pos+n])
+		ecs = append(ecs, qrRemainder(data[pos:pos+n], gen))
+		pos += n
+	}
+	words := make([]byte, 0, capacity+b.ec*len(blocks))
+	for i := 0; i < max(b.d1, b.d2); i++ {
+		for _, blk := range blocks {
+			if i < len(blk) {
+				words = append(words, blk[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, e := range ecs {
+			words = append(words, e[i])
+		}
+	}
+
+	// 4. Place patterns and codewords, keep mask of least penalty
+	q := newQRMatrix(ver)
+	q.place(words)
+	var best [][]bool
+	bestScore := -1
+	for mask := 0; mask < 8; mask++ {
+		q.mask(mask)
+		q.format(mask)
+		if score := q.penalty(); bestScore < 0 || score < bestScore {
+			best, bestScore = q.copy(), score
+		}
+		q.mask(mask) // undo
+	}
+	return best, nil
+}
+
+// multiply in GF(256) of 0x11D
+func qrMul(x byte, y byte) byte {
+	var z byte
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x1D
+		z ^= (y >> i & 1) * x
+	}
+	return z
+}
+
+// reed-solomon generator of degree, leading 1 is omitted
+func qrGenerator(degree int) []byte {
+	res := make([]byte, degree)
+	res[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range res {
+			res[j] = qrMul(res[j], root)
+			if j+1 < len(res) {
+				res[j] ^= res[j+1]
+			}
+		}
+		root = qrMul(root, 0x02)
+	}
+	return res
+}
+
+// error correction codewords of data
+func qrRemainder(data []byte, gen []byte) []byte {
+	res := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ res[0]
+		copy(res, res[1:])
+		res[len(res)-1] = 0
+		for i := range res {
+			res[i] ^= qrMul(gen[i], factor)
+		}
+	}
+	return res
+}
+
+type qrMatrix struct {
+	size  int
+	dark  [][]bool
+	fixed [][]bool // function patterns, not masked
+}
+
+// matrix with function patterns of version
+func newQRMatrix(ver int) *qrMatrix {
+	q := &qrMatrix{size: 4*ver + 17}
+	q.dark, q.fixed = make([][]bool, q.size), make([][]bool, q.size)
+	for y := range q.size {
+		q.dark[y], q.fixed[y] = make([]bool, q.size), make([]bool, q.size)
+	}
+
+	// timing, finder and alignment patterns
+	for i := range q.size {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if d := max(qrAbs(dx), qrAbs(dy)); x >= 0 && x < q.size && y >= 0 && y < q.size {
+					q.set(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qrAlign[ver]
+	for i := range pos {
+		for j := range pos {
+			if (i == 0 && j == 0) || (i == 0 && j == len(pos)-1) || (i == len(pos)-1 && j == 0) {
+				continue // finder corners
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(pos[i]+dx, pos[j]+dy, max(qrAbs(dx), qrAbs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// reserve format, version bits
+	q.format(0)
+	if ver >= 7 {
+		bits := qrVersionBits(ver)
+		for i := range 18 {
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, bits>>i&1 == 1)
+			q.set(b, a, bits>>i&1 == 1)
+		}
+	}
+	return q
+}
+
+// version bits with BCH(18,6) code
+func qrVersionBits(ver int) int {
+	rem := ver
+	for range 12 {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	return ver<<12 | rem
+}
+
+// format bits of level M and mask with BCH(15,5) code
+func qrFormatBits(mask int) int {
+	rem := mask
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	return (mask<<10 | rem) ^ 0x5412
+}
+
+func qrAbs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (q *qrMatrix) set(x int, y int, dark bool) {
+	q.dark[y][x] = dark
+	q.fixed[y][x] = true
+}
+
+// place format bits of level M and mask
+func (q *qrMatrix) format(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// codewords in zigzag column pairs from bottom right
+func (q *qrMatrix) place(words []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := range q.size {
+			for j := range 2 {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.fixed[y][x] && i < len(words)*8 {
+					q.dark[y][x] = words[i>>3]>>(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// xor data modules with mask pattern
+func (q *qrMatrix) mask(mask int) {
+	for y := range q.size {
+		for x := range q.size {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !q.fixed[y][x] {
+				q.dark[y][x] = !q.dark[y][x]
+			}
+		}
+	}
+}
+
+// penalty of runs, boxes, finder-like patterns and dark balance
+func (q *qrMatrix) penalty() int {
+	score, dark := 0, 0
+	at := func(x int, y int, col bool) bool {
+		if col {
+			return q.dark[x][y]
+		}
+		return q.dark[y][x]
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for _, col := range []bool{false, true} {
+		for y := range q.size {
+			run := 0
+			for x := range q.size {
+				if x > 0 && at(x, y, col) == at(x-1, y, col) {
+					run++
+				} else {
+					run = 1
+				}
+				if run == 5 {
+					score += 3
+				} else if run > 5 {
+					score++
+				}
+
+				// 1:1:3:1:1 with 4 light modules on one side
+				if x+7 > q.size {
+					continue
+				}
+				match := true
+				for i, d := range finder {
+					match = match && at(x+i, y, col) == d
+				}
+				if !match {
+					continue
+				}
+				before, after := true, true
+				for i := 1; i <= 4; i++ {
+					before = before && (x-i < 0 || !at(x-i, y, col))
+					after = after && (x+6+i >= q.size || !at(x+6+i, y, col))
+				}
+				if before || after {
+					score += 40
+				}
+			}
+		}
+	}
+	for y := range q.size {
+		for x := range q.size {
+			if q.dark[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 && q.dark[y][x] == q.dark[y][x-1] && q.dark[y][x] == q.dark[y-1][x] && q.dark[y][x] == q.dark[y-1][x-1] {
+				score += 3
+			}
+		}
+	}
+	total := q.size * q.size
+	return score + (qrAbs(dark*20-total*10)+total-1)/total*10 - 10
+}
+
+func (q *qrMatrix) copy() [][]bool {
+	res := make([][]bool, q.size)
+	for y := range q.size {
+		res[y] = slices.Clone(q.dark[y])
+	}
+	return res
+}
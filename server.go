@@ -0,0 +1,202 @@
+// project USAG AFT-desktop library: receiver daemon
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// status of one server session
+type TPsession struct {
+	ID    int
+	Addr  string // peer address
+	Start time.Time
+	Stage int
+	Sent  uint64
+	Total uint64
+	Name  string // session folder in inbox, or stored name in vault
+	Smsg  string
+	Err   error
+}
+
+// receiver daemon, runs one protocol per sender
+type TPserver struct {
+	Inbox      string              // received files go to new folder per session
+	Vault      *AVault             // receive into vault root instead of inbox
+	MaxConns   int                 // concurrent sessions, 0 is 8
+	MaxPerPeer int                 // concurrent sessions per peer IP, 0 is 2
+	Setup      func(p *TPprotocol) // configure each protocol before receive, must not prompt for shared fields
+	Done       func(s TPsession)   // called after each session, refused ones too
+	lock       sync.Mutex
+	nextID     int
+	sessions   map[int]*serverSession
+	perPeer    map[string]int
+	refusing   int // refusals waiting for hello, at most MaxConns
+}
+
+type serverSession struct {
+	info TPsession
+	p    *TPprotocol
+}
+
+// accept senders until ctx is done, waits for running sessions
+func (s *TPserver) Serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var delay time.Duration // retry temporary accept errors like out of fds
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return nil
+				}
+				continue
+			}
+			return err
+		}
+		delay = 0
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handle(ctx, conn)
+		}()
+	}
+}
+
+// status of running sessions by ID
+func (s *TPserver) Sessions() []TPsession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := make([]TPsession, 0, len(s.sessions))
+	for _, ss := range s.sessions {
+		info := ss.info
+		info.Stage, info.Sent, info.Total = ss.p.GetStatus()
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// register session, returns error if over limits
+func (s *TPserver) add(ss *serverSession, host string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[int]*serverSession)
+		s.perPeer = make(map[string]int)
+	}
+	s.nextID++
+	ss.info.ID = s.nextID
+	maxConns, maxPeer := s.maxConns(), s.MaxPerPeer
+	if maxPeer <= 0 {
+		maxPeer = 2
+	}
+	if len(s.sessions) >= maxConns {
+		return errors.New("server is busy")
+	} else if s.perPeer[host] >= maxPeer {
+		return errors.New("too many sessions from peer")
+	}
+	s.sessions[ss.info.ID] = ss
+	s.perPeer[host]++
+	return nil
+}
+
+func (s *TPserver) maxConns() int {
+	if s.MaxConns <= 0 {
+		return 8
+	}
+	return s.MaxConns
+}
+
+// count pending refusal, false if too many are waiting for hello
+func (s *TPserver) refusal(delta int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if delta > 0 && s.refusing >= s.maxConns() {
+		return false
+	}
+	s.refusing += delta
+	return true
+}
+
+func (s *TPserver) remove(ss *serverSession, host string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.sessions, ss.info.ID)
+	if s.perPeer[host]--; s.perPeer[host] <= 0 {
+		delete(s.perPeer, host)
+	}
+}
+
+// run one session, refused sender gets handshake reject
+func (s *TPserver) handle(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	addr := conn.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ss := &serverSession{info: TPsession{Addr: addr, Start: time.Now()}, p: new(TPprotocol)}
+	p := ss.p
+	p.Init(0, conn)
+	if s.Setup != nil {
+		s.Setup(p)
+	}
+
+	// 1. Refuse over limits with reason in short time, close at once if many refusals are pending
+	if err := s.add(ss, host); err != nil {
+		if s.refusal(1) {
+			p.refuse = err
+			p.TotalTimeout = 2 * time.Second
+			p.ReceiveDataContext(ctx)
+			s.refusal(-1)
+		}
+		ss.info.Err = err
+		ss.info.Stage = STAGE_ERROR
+		if s.Done != nil {
+			s.Done(ss.info)
+		}
+		return
+	}
+	defer s.remove(ss, host)
+
+	// 2. Receive into vault or new inbox folder, info is read by Sessions under lock
+	var name, smsg string
+	if s.Vault != nil {
+		_, _, name, smsg, err = p.ReceiveVaultContext(ctx, s.Vault, "")
+	} else {
+		name = fmt.Sprintf("%s_%d", ss.info.Start.Format("20060102-150405"), ss.info.ID)
+		s.lock.Lock()
+		ss.info.Name = name
+		s.lock.Unlock()
+		dir := filepath.Join(s.Inbox, name)
+		_, _, _, smsg, err = p.ReceiveFilesContext(ctx, dir)
+		if err != nil {
+			os.Remove(dir) // only if empty
+		}
+	}
+	s.lock.Lock()
+	ss.info.Name, ss.info.Smsg, ss.info.Err = name, smsg, err
+	ss.info.Stage, ss.info.Sent, ss.info.Total = p.GetStatus()
+	info := ss.info
+	s.lock.Unlock()
+	if s.Done != nil {
+		s.Done(info)
+	}
+}
@@ -0,0 +1,183 @@
+// project USAG AFT-desktop library: browser share links
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k-atusa/USAG-Lib/Bencrypt"
+)
+
+// one-time download link for browsers, serves single file over http
+type TPshare struct {
+	Name    string                                // file name given to browser
+	Open    func() (io.ReadCloser, int64, error)  // plain body and size, called per download
+	Timeout time.Duration                         // link expires after, running download is stopped, 0 is SHARE_TIMEOUT
+	Token   string                                // random url path, only holder can download
+	Done    func(addr string, n int64, err error) // called after each download attempt
+	used    atomic.Bool
+	busy    atomic.Bool
+}
+
+// new share with random token
+func NewShare(name string, open func() (io.ReadCloser, int64, error)) *TPshare {
+	return &TPshare{Name: name, Open: open, Token: hex.EncodeToString(Bencrypt.Random(16))}
+}
+
+// share file on disk
+func ShareFile(path string) (*TPshare, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		return nil, errors.New("cannot share folder")
+	}
+	return NewShare(filepath.Base(path), func() (io.ReadCloser, int64, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}), nil
+}
+
+// share file in vault, decrypted in memory only while downloading
+func ShareVault(v *AVault, name string) (*TPshare, error) {
+	if strings.HasSuffix(name, "/") {
+		return nil, errors.New("cannot share folder")
+	} else if !v.exists(name) {
+		return nil, errors.New("file not found in vault")
+	}
+	return NewShare(path.Base(name), func() (io.ReadCloser, int64, error) {
+		data, err := v.Read(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+	}), nil
+}
+
+// download link at host and port
+func (s *TPshare) URL(host string, port int) string {
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/" + s.Token + "/" + url.PathEscape(s.Name)
+}
+
+// serve until first complete download, Timeout or ctx is done
+func (s *TPshare) Serve(ctx context.Context, ln net.Listener) error {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = SHARE_TIMEOUT
+	}
+	done := make(chan struct{})
+	var once sync.Once
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if s.handle(w, r) {
+				once.Do(func() { close(done) })
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	// finish response of complete download, drop others
+	var err error
+	select {
+	case <-done:
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		srv.Shutdown(sctx)
+		cancel()
+	case <-timer.C:
+		srv.Close()
+		err = ErrShareExpired
+	case <-ctx.Done():
+		srv.Close()
+		err = ctx.Err()
+	case err = <-served:
+		return err
+	}
+	<-served
+	return err
+}
+
+// serve one request, returns true if whole file is written
+func (s *TPshare) handle(w http.ResponseWriter, r *http.Request) bool {
+	// 1. Check token, method and state
+	token, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !hmac.Equal([]byte(token), []byte(s.Token)) {
+		http.NotFound(w, r)
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if s.used.Load() {
+		http.Error(w, "link already used", http.StatusGone)
+		return false
+	}
+	if !s.busy.CompareAndSwap(false, true) {
+		http.Error(w, "download in progress", http.StatusServiceUnavailable)
+		return false
+	}
+	defer s.busy.Store(false)
+
+	// 2. Open body, HEAD does not use link
+	rd, size, err := s.Open()
+	if err != nil {
+		http.Error(w, "file not available", http.StatusInternalServerError)
+		if s.Done != nil {
+			s.Done(r.RemoteAddr, 0, err)
+		}
+		return false
+	}
+	defer rd.Close()
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(size, 10))
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": s.Name}))
+	h.Set("Cache-Control", "no-store")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return false
+	}
+
+	// 3. Send body, link is used only if all bytes are written
+	n, err := io.Copy(w, rd)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		s.used.Store(true)
+	}
+	if s.Done != nil {
+		s.Done(r.RemoteAddr, n, err)
+	}
+	return err == nil
+}
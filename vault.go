@@ -0,0 +1,775 @@
+// project USAG AFT-desktop library: AFT vault
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/k-atusa/USAG-Lib/Bencode"
+	"github.com/k-atusa/USAG-Lib/Bencrypt"
+	"github.com/k-atusa/USAG-Lib/Icons"
+	"github.com/k-atusa/USAG-Lib/Opsec"
+)
+
+// AFT Vault
+type AVault struct {
+	Path  string
+	Limit int64
+	// name rule: *, */, */*
+
+	Algo    string // ecc1, rsa1, pqc1
+	Ext     string // webp, png, bin
+	Public  []byte
+	Private []byte
+
+	TreeView map[string][]string // treeview with plain name
+	PtoCtbl  map[string]string   // plain name -> cipher name
+	CtoPtbl  map[string]string   // cipher name -> plain name
+	lock     sync.Mutex          // Read and Write, for concurrent receivers
+}
+
+func (a *AVault) prehead() []byte {
+	var ico Icons.Icons
+	var v []byte
+	switch a.Ext {
+	case "webp":
+		v, _ = ico.Zip_webp()
+	case "png":
+		v, _ = ico.Zip_png()
+	default:
+		return nil
+	}
+	v = append(v, make([]byte, 128-len(v)%128)...)
+	return v
+}
+
+func (a *AVault) NewKeypair() error {
+	var err error
+	if a.Algo == "ecc1" {
+		a.Public, a.Private, err = new(Bencrypt.ECC1).Genkey()
+	} else if a.Algo == "pqc1" {
+		a.Public, a.Private, err = genHybrid()
+	} else if a.Algo == "rsa1" {
+		a.Public, a.Private, err = new(Bencrypt.RSA1).Genkey(4096)
+	} else {
+		return errors.New("unsupported algorithm")
+	}
+	return err
+}
+
+// load vault from disk
+func (a *AVault) Load(pw string, kf []byte) (string, error) {
+	// 1. find account.*, name.* files
+	files, err := os.ReadDir(a.Path)
+	if err != nil {
+		return "", err
+	}
+	found := 0
+	accPath := ""
+	nmPath := ""
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), "account.") && !strings.HasSuffix(f.Name(), ".old") {
+			found++
+			accPath = filepath.Join(a.Path, f.Name())
+		}
+		if !f.IsDir() && strings.HasPrefix(f.Name(), "name.") && !strings.HasSuffix(f.Name(), ".old") {
+			found++
+			nmPath = filepath.Join(a.Path, f.Name())
+		}
+	}
+	if found != 2 {
+		return "", errors.New("cannot find data files")
+	}
+
+	// 2. Read account file
+	accData, err := os.ReadFile(accPath)
+	if err != nil {
+		return "", err
+	}
+	var opsAcc Opsec.Opsec
+	opsAcc.Reset()
+	h, err := opsAcc.Read(bytes.NewReader(accData), 0)
+	if err != nil {
+		return "", err
+	}
+	if err := view(&opsAcc, h); err != nil {
+		return "", err
+	}
+	if err := opsAcc.Decpw([]byte(pw), kf); err != nil {
+		return opsAcc.Msg, err
+	}
+
+	// Load Smsg (Algo, Ext, Public, Private)
+	parts := strings.Split(opsAcc.Smsg, "\n")
+	if len(parts) != 4 {
+		return opsAcc.Msg, errors.New("invalid account format")
+	}
+	a.Algo = parts[0]
+	a.Ext = parts[1]
+	b := new(Bencode.Bencode)
+	b.Init()
+	a.Public, err = b.Decode(parts[2])
+	if err != nil {
+		return opsAcc.Msg, err
+	}
+	a.Private, err = b.Decode(parts[3])
+	if err != nil {
+		return opsAcc.Msg, err
+	}
+
+	// 3. Read name file
+	nameData, err := os.ReadFile(nmPath)
+	if err != nil {
+		return opsAcc.Msg, err
+	}
+	var opsName Opsec.Opsec
+	opsName.Reset()
+	rd := bytes.NewReader(nameData)
+	h, err = opsName.Read(rd, 0)
+	if err != nil {
+		return opsAcc.Msg, err
+	}
+	if err := view(&opsName, h); err != nil {
+		return opsAcc.Msg, err
+	}
+	if err := decpub(&opsName, a.Algo, a.Private, a.Public); err != nil {
+		return opsAcc.Msg, err
+	}
+
+	// 4. Decrypt body
+	var key [44]byte
+	copy(key[:], opsName.BodyKey)
+	aes := new(Bencrypt.AES1)
+	encBody := make([]byte, opsName.Size)
+	io.ReadFull(rd, encBody)
+	decBody, err := aes.DeAESGCM(key, encBody)
+	encBody = nil
+	if err != nil {
+		return opsAcc.Msg, err
+	}
+
+	// 5. Parse NameTable (\n delimiter)
+	nameLines := strings.Split(string(decBody), "\n")
+	decBody = nil
+	a.PtoCtbl = make(map[string]string)
+	a.CtoPtbl = make(map[string]string)
+	for i := 0; i < len(nameLines)-1; i += 2 {
+		if i+1 < len(nameLines) {
+			a.PtoCtbl[nameLines[i]] = nameLines[i+1]
+			a.CtoPtbl[nameLines[i+1]] = nameLines[i]
+		}
+	}
+
+	// 6. make name tree
+	a.TreeView = make(map[string][]string)
+	a.TreeView[""] = make([]string, 0)
+	for plain := range a.PtoCtbl {
+		idx := strings.IndexAny(plain, "/")
+		if idx == -1 { // golbal file
+			a.TreeView[""] = append(a.TreeView[""], plain)
+		} else { // folder or file in folder
+			parent, child := plain[:idx+1], plain[idx+1:]
+			if _, ok := a.TreeView[parent]; !ok { // add parent folder
+				a.TreeView[parent] = make([]string, 0)
+			}
+			if child == "" { // add parent folder to root
+				a.TreeView[""] = append(a.TreeView[""], parent)
+			} else { // add child file
+				a.TreeView[parent] = append(a.TreeView[parent], child)
+			}
+		}
+	}
+	for parent := range a.TreeView {
+		sort.Strings(a.TreeView[parent])
+	}
+	a.Limit = 512 * 1024 * 1024
+	return opsAcc.Msg, nil
+}
+
+// store name table to disk
+func (a *AVault) StoreName() error {
+	// make name list binary
+	nameList := make([]string, 2*len(a.PtoCtbl))
+	idx := 0
+	for plain, cipher := range a.PtoCtbl {
+		nameList[idx] = plain
+		nameList[idx+1] = cipher
+		idx += 2
+	}
+	data := []byte(strings.Join(nameList, "\n"))
+	nameList = nil
+
+	// make header
+	var ops Opsec.Opsec
+	ops.Reset()
+	ops.Size = int64(len(data)) + 16
+	header, err := encpub(&ops, a.Algo, a.Public, a.Private)
+	if err != nil {
+		return err
+	}
+
+	// encrypt body
+	var key [44]byte
+	copy(key[:], ops.BodyKey)
+	aes := new(Bencrypt.AES1)
+	encBody, err := aes.EnAESGCM(key, data)
+	data = nil
+	if err != nil {
+		return err
+	}
+
+	// write to file
+	path := filepath.Join(a.Path, "name."+a.Ext)
+	os.Rename(path, path+".old")
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	prehead := a.prehead()
+	if prehead != nil {
+		file.Write(prehead)
+	}
+	if err := ops.Write(file, header); err != nil {
+		return err
+	}
+	file.Write(encBody)
+	return nil
+}
+
+// store account to disk
+func (a *AVault) StoreAccount(pw string, kf []byte, msg string) error {
+	// make account text
+	b := new(Bencode.Bencode)
+	b.Init()
+	data := strings.Join([]string{a.Algo, a.Ext, b.Encode(a.Public, true), b.Encode(a.Private, true)}, "\n")
+
+	// make header
+	var ops Opsec.Opsec
+	ops.Reset()
+	ops.Msg = msg
+	ops.Smsg = data
+	algo := "arg1"
+	if a.Algo == "rsa1" {
+		algo = "pbk1"
+	}
+	header, err := ops.Encpw(algo, []byte(pw), kf)
+	if err != nil {
+		return err
+	}
+
+	// write to file
+	path := filepath.Join(a.Path, "account."+a.Ext)
+	os.Rename(path, path+".old")
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	prehead := a.prehead()
+	if prehead != nil {
+		file.Write(prehead)
+	}
+	return ops.Write(file, header)
+}
+
+// add file or folder to vault
+func (a *AVault) Add(path string, dirname string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	// add file, assume dirname exists
+	if !info.IsDir() {
+		if info.Size() > a.Limit {
+			return errors.New("file size too big")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return a.Write(dirname+info.Name(), data)
+	}
+
+	// add folder (single layer)
+	if _, ok := a.PtoCtbl[info.Name()+"/"]; ok {
+		return errors.New("folder already exists")
+	}
+	cParent := ""
+	for {
+		cParent = hex.EncodeToString(Bencrypt.Random(12)) + "/"
+		if _, collision := a.CtoPtbl[cParent]; !collision {
+			break
+		}
+	}
+	os.Mkdir(filepath.Join(a.Path, cParent), 0755)
+	a.PtoCtbl[info.Name()+"/"] = cParent
+	a.CtoPtbl[cParent] = info.Name() + "/"
+	a.TreeView[info.Name()+"/"] = make([]string, 0)
+	a.TreeView[""] = append(a.TreeView[""], info.Name()+"/")
+	sort.Strings(a.TreeView[""])
+
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return a.StoreName() // store empty folder
+	}
+	for _, file := range files {
+		if !file.IsDir() { // add only first layer
+			if err := a.Add(filepath.Join(path, file.Name()), info.Name()+"/"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// delete file or folder from vault
+func (a *AVault) Del(name string) error {
+	isFolder := strings.HasSuffix(name, "/")
+
+	// delete actual files, update tables
+	for plain, cipher := range a.PtoCtbl {
+		if plain == name || (isFolder && strings.HasPrefix(plain, name)) {
+			os.RemoveAll(filepath.Join(a.Path, cipher))
+			delete(a.CtoPtbl, cipher)
+			delete(a.PtoCtbl, plain)
+		}
+	}
+
+	// update treeview
+	if isFolder {
+		list := a.TreeView[""]
+		for i, v := range list {
+			if v == name {
+				a.TreeView[""] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+		delete(a.TreeView, name)
+
+	} else {
+		parent, child := "", name
+		if idx := strings.Index(name, "/"); idx != -1 {
+			parent, child = name[:idx+1], name[idx+1:]
+		}
+		list := a.TreeView[parent]
+		for i, v := range list {
+			if v == child {
+				a.TreeView[parent] = append(list[:i], list[i+1:]...)
+				break
+			}
+		}
+	}
+	return a.StoreName()
+}
+
+// rename file or folder in vault
+func (a *AVault) Rename(src string, dst string) error {
+	// check source
+	if _, ok := a.PtoCtbl[src]; !ok {
+		return errors.New("source not found")
+	}
+	if _, ok := a.PtoCtbl[dst]; ok {
+		return errors.New("destination already exists")
+	}
+	isFolder := strings.HasSuffix(src, "/")
+	if isFolder && !strings.HasSuffix(dst, "/") {
+		return errors.New("invalid destination for folder")
+	}
+	idx0 := strings.Index(src, "/")
+	idx1 := strings.Index(dst, "/")
+	if !isFolder {
+		dir0 := ""
+		if idx0 != -1 {
+			dir0 = src[:idx0+1]
+		}
+		dir1 := ""
+		if idx1 != -1 {
+			dir1 = dst[:idx1+1]
+		}
+		if dir0 != dir1 {
+			return errors.New("invalid destination for file")
+		}
+	}
+
+	// rename tables
+	for pName, cName := range a.PtoCtbl {
+		if pName == src || (isFolder && strings.HasPrefix(pName, src)) {
+			updatedPName := dst + pName[len(src):]
+			delete(a.PtoCtbl, pName)
+			delete(a.CtoPtbl, cName)
+			a.PtoCtbl[updatedPName] = cName
+			a.CtoPtbl[cName] = updatedPName
+		}
+	}
+
+	// update treeview
+	if isFolder {
+		idx := slices.Index(a.TreeView[""], src)
+		if idx != -1 {
+			a.TreeView[""][idx] = dst
+			sort.Strings(a.TreeView[""])
+		}
+		a.TreeView[dst] = a.TreeView[src]
+		delete(a.TreeView, src)
+
+	} else {
+		parent, oldChild := "", src
+		if idx0 != -1 {
+			parent, oldChild = src[:idx0+1], src[idx0+1:]
+		}
+		newChild := dst
+		if idx1 != -1 {
+			newChild = dst[idx1+1:]
+		}
+		idx := slices.Index(a.TreeView[parent], oldChild)
+		if idx != -1 {
+			a.TreeView[parent][idx] = newChild
+			sort.Strings(a.TreeView[parent])
+		}
+	}
+	return a.StoreName()
+}
+
+// read file from vault
+func (a *AVault) Read(name string) ([]byte, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// find cipher name, read file
+	cipher, ok := a.PtoCtbl[name]
+	if !ok {
+		return nil, errors.New("file not found in vault")
+	}
+	data, err := os.ReadFile(filepath.Join(a.Path, cipher))
+	if err != nil {
+		return nil, err
+	}
+
+	// read header
+	var ops Opsec.Opsec
+	ops.Reset()
+	rd := bytes.NewReader(data)
+	h, err := ops.Read(rd, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := view(&ops, h); err != nil {
+		return nil, err
+	}
+	if err := decpub(&ops, a.Algo, a.Private, a.Public); err != nil {
+		return nil, err
+	}
+
+	// decrypt body
+	var key [44]byte
+	copy(key[:], ops.BodyKey)
+	aes := new(Bencrypt.AES1)
+	body := make([]byte, ops.Size)
+	io.ReadFull(rd, body)
+	return aes.DeAESGCM(key, body)
+}
+
+// write file to vault, make new if not exists
+func (a *AVault) Write(name string, data []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.write(name, data)
+}
+
+// write new file to vault, fails if exists
+func (a *AVault) create(name string, data []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, ok := a.PtoCtbl[name]; ok {
+		return errors.New("file already exists in vault: " + name)
+	}
+	return a.write(name, data)
+}
+
+// copy of folder entries in TreeView, "" is root
+func (a *AVault) children(folder string) ([]string, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	names, ok := a.TreeView[folder]
+	return slices.Clone(names), ok
+}
+
+func (a *AVault) exists(name string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, ok := a.PtoCtbl[name]
+	return ok
+}
+
+func (a *AVault) write(name string, data []byte) error {
+	// check size
+	if int64(len(data)) > a.Limit {
+		return errors.New("file size too big")
+	}
+
+	// check exists
+	cipher, exists := a.PtoCtbl[name]
+	if !exists {
+		// split name
+		parent, child := "", name
+		if idx := strings.Index(name, "/"); idx != -1 {
+			parent = name[:idx+1]
+			child = name[idx+1:]
+		}
+
+		// make new cipher name, update tables
+		for {
+			cChild := hex.EncodeToString(Bencrypt.Random(12)) + "." + a.Ext
+			if parent == "" {
+				cipher = cChild
+			} else {
+				cipher = a.PtoCtbl[parent] + cChild
+			}
+			if _, collision := a.CtoPtbl[cipher]; !collision {
+				break
+			}
+		}
+		a.PtoCtbl[name] = cipher
+		a.CtoPtbl[cipher] = name
+
+		// update treeview
+		if _, ok := a.TreeView[parent]; !ok {
+			a.TreeView[parent] = make([]string, 0)
+		}
+		a.TreeView[parent] = append(a.TreeView[parent], child)
+		sort.Strings(a.TreeView[parent])
+	}
+
+	// make header
+	var ops Opsec.Opsec
+	ops.Reset()
+	ops.Size = int64(len(data)) + 16
+	ops.BodyAlgo = "gcm1"
+	header, err := encpub(&ops, a.Algo, a.Public, a.Private)
+	if err != nil {
+		return err
+	}
+
+	// encrypt body
+	var key [44]byte
+	copy(key[:], ops.BodyKey)
+	aes := new(Bencrypt.AES1)
+	encBody, err := aes.EnAESGCM(key, data)
+	data = nil
+	if err != nil {
+		return err
+	}
+
+	// write file, old content stays until new one is complete
+	err = writeAtomic(filepath.Join(a.Path, cipher), func(w io.Writer) error {
+		if pre := a.prehead(); pre != nil {
+			if _, err := w.Write(pre); err != nil {
+				return err
+			}
+		}
+		if err := ops.Write(w, header); err != nil {
+			return err
+		}
+		_, err := w.Write(encBody)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return a.StoreName()
+}
+
+// sync vault with file system
+func (a *AVault) Trim() (int, error) {
+	count := 0
+
+	// delete registered but not exists
+	for plain, cipher := range a.PtoCtbl {
+		fPath := filepath.Join(a.Path, cipher)
+		if _, err := os.Stat(fPath); os.IsNotExist(err) {
+			delete(a.PtoCtbl, plain)
+			delete(a.CtoPtbl, cipher)
+			count++
+		}
+	}
+
+	// delete unregistered but exists
+	err := filepath.Walk(a.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == a.Path {
+			return nil
+		}
+		rel, _ := filepath.Rel(a.Path, path)
+		rel = filepath.ToSlash(rel)
+
+		// skip account and name files
+		if strings.HasPrefix(rel, "account.") || strings.HasPrefix(rel, "name.") {
+			return nil
+		}
+
+		// make lookup key
+		key := rel
+		if info.IsDir() {
+			key += "/"
+		}
+
+		// delete if not exists in table
+		if _, ok := a.CtoPtbl[key]; !ok {
+			os.RemoveAll(path)
+			count++
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	// rebuild treeview
+	a.TreeView = make(map[string][]string)
+	a.TreeView[""] = make([]string, 0)
+	for plain := range a.PtoCtbl {
+		idx := strings.Index(plain, "/")
+		if idx == -1 { // global files
+			a.TreeView[""] = append(a.TreeView[""], plain)
+		} else { // folders and files in folders
+			parent, child := plain[:idx+1], plain[idx+1:]
+			if _, ok := a.TreeView[parent]; !ok { // add parent folder
+				a.TreeView[parent] = make([]string, 0)
+			}
+			if child == "" { // add parent folder to root
+				a.TreeView[""] = append(a.TreeView[""], parent)
+			} else { // add child file
+				a.TreeView[parent] = append(a.TreeView[parent], child)
+			}
+		}
+	}
+
+	// sort and save
+	for k := range a.TreeView {
+		sort.Strings(a.TreeView[k])
+	}
+	return count, a.StoreName()
+}
+
+// Send vault file by plain name, plaintext stays in memory, public key is [from, to]
+func (p *TPprotocol) SendVault(v *AVault, name string, smsg string) ([]byte, []byte, error) {
+	return p.SendVaultContext(context.Background(), v, name, smsg)
+}
+
+// SendVault aborted when ctx is done
+func (p *TPprotocol) SendVaultContext(ctx context.Context, v *AVault, name string, smsg string) ([]byte, []byte, error) {
+	data, err := v.Read(name)
+	if err != nil {
+		p.setStage(STAGE_ERROR)
+		return nil, nil, p.failed(err)
+	}
+	defer clear(data)
+	if p.OfferName == "" {
+		p.OfferName = name[strings.LastIndex(name, "/")+1:]
+	}
+	return p.SendDataContext(ctx, data, smsg)
+}
+
+// Receive into unlocked vault, plaintext stays in memory.
+// name is plain name, or folder ending with '/' ("" is root) to use offer name.
+// returns (peer public key, my public key, stored name, smsg)
+func (p *TPprotocol) ReceiveVault(v *AVault, name string) ([]byte, []byte, string, string, error) {
+	return p.ReceiveVaultContext(context.Background(), v, name)
+}
+
+// ReceiveVault aborted when ctx is done
+func (p *TPprotocol) ReceiveVaultContext(ctx context.Context, v *AVault, name string) ([]byte, []byte, string, string, error) {
+	// 1. Check name is free and folder exists, cap size to vault limit
+	if name != "" && !strings.HasSuffix(name, "/") && v.exists(name) {
+		p.setStage(STAGE_ERROR)
+		return nil, nil, "", "", p.failed(errors.New("file already exists in vault: " + name))
+	}
+	if idx := strings.Index(name, "/"); idx != -1 {
+		if !v.exists(name[:idx+1]) || strings.Contains(name[idx+1:], "/") {
+			p.setStage(STAGE_ERROR)
+			return nil, nil, "", "", p.failed(errors.New("folder not found in vault: " + name))
+		}
+	}
+	limit := p.MaxSize
+	if p.MaxSize <= 0 || p.MaxSize > v.Limit {
+		p.MaxSize = v.Limit
+	}
+	defer func() { p.MaxSize = limit }()
+
+	// 2. Receive to memory, write to vault before sender is told of success
+	var buf bytes.Buffer
+	p.memory = true
+	defer func() { p.memory = false }()
+	end := p.begin(ctx)
+	defer end()
+	peerPub, myPub, smsg, err := p.receiveVault(v, &name, &buf)
+	defer clear(buf.Bytes())
+	err = p.cause(err)
+	if err != nil {
+		name = ""
+	}
+	return peerPub, myPub, name, smsg, p.record("recv", p.offer.Name, peerPub, smsg, err)
+}
+
+func (p *TPprotocol) receiveVault(v *AVault, name *string, buf *bytes.Buffer) ([]byte, []byte, string, error) {
+	p.setStage(STAGE_HANDSHAKE)
+	peerPub, myPub, myPriv, err := p.handshakeReceive()
+	if err != nil {
+		p.setStage(STAGE_ERROR)
+		return peerPub, myPub, "", err
+	}
+	smsg, err := p.receiveBody(buf, peerPub, myPriv, func() error {
+		if *name == "" || strings.HasSuffix(*name, "/") {
+			child := p.offer.Name
+			if child == "" || strings.ContainsAny(child, "/\\\x00") { // sender gave no usable name
+				child = hex.EncodeToString(Bencrypt.Random(8))
+			}
+			*name += child
+		}
+		data, err := vaultBody(p.Mode, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		return v.create(*name, data)
+	})
+	return peerPub, myPub, smsg, err
+}
+
+// strip manifest of single file sent with SendFiles
+func vaultBody(mode uint16, data []byte) ([]byte, error) {
+	if mode&MODE_FILES == 0 {
+		return data, nil
+	}
+	if len(data) < 4 || Opsec.DecodeInt(data[0:4]) > uint64(len(data)-4) {
+		return nil, errors.New("invalid manifest")
+	}
+	size := int(Opsec.DecodeInt(data[0:4]))
+	files, err := decodeManifest(data[4 : 4+size])
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != 1 || strings.HasSuffix(files[0].Name, "/") {
+		return nil, errors.New("only one file can be received into vault")
+	}
+	data = data[4+size:]
+	if int64(len(data)) != files[0].Size {
+		return nil, errors.New("invalid manifest")
+	}
+	return data, nil
+}